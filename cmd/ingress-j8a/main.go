@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/simonmittag/ingress-j8a/server"
@@ -16,17 +17,26 @@ const (
 	Server Mode = 1 << iota
 	Version
 	Usage
+	Status
+	Manifests
 )
 
 func main() {
 	mode := Server
-	go waitForSignal()
-
-	//for Bootstrap
 	defer recovery()
 
 	v := flag.Bool("v", false, "print the server version")
 	h := flag.Bool("h", false, "print usage instructions")
+	features := server.DefaultFeatures()
+	featureFlags(flag.CommandLine, &features)
+	auth := server.NewAuth()
+	authFlags(flag.CommandLine, auth)
+	grace := flag.Duration("shutdown-grace", time.Second*30, "time to finish the current reconcile after a shutdown signal")
+	defaultCert := flag.String("default-ssl-certificate", "", "namespace/name of a tls secret served for hosts without a valid certificate")
+	expiryWarning := flag.Duration("cert-expiry-warning", time.Hour*24*14, "warn on ingress when its certificate expires within this duration")
+	metricsAddr := flag.String("metrics-addr", ":9090", "address to serve prometheus metrics on, empty disables metrics")
+	config := flag.String("config", "", "path to the controller config file, overridden by INGRESS_J8A_* env and flags")
+	j8a := j8aFlags(flag.CommandLine)
 	flag.Usage = printUsage
 	flag.Parse()
 	if *v {
@@ -35,17 +45,41 @@ func main() {
 	if *h {
 		mode = Usage
 	}
+	switch flag.Arg(0) {
+	case "status":
+		mode = Status
+	case "manifests":
+		mode = Manifests
+	}
 
 	switch mode {
 	case Server:
-		server.
-			NewServer().
-			Bootstrap().
-			Daemon()
+		s := configure(*config, j8a)
+		s.Features = features
+		s.Kube.Auth = auth
+		s.ShutdownGrace = *grace
+		s.CertExpiryWarning = *expiryWarning
+		s.MetricsAddr = *metricsAddr
+		if len(*defaultCert) > 0 {
+			if _, _, e := server.ParseNamespacedName(*defaultCert); e != nil {
+				fmt.Fprintf(os.Stderr, "invalid -default-ssl-certificate, cause: %v\n", e)
+				os.Exit(-1)
+			}
+			s.DefaultCertificate = *defaultCert
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+		defer stop()
+		if e := s.Run(ctx); e != nil {
+			s.Log.Fatalf("shutdown cause: %v", e)
+		}
 	case Version:
 		printVersion()
 	case Usage:
 		printUsage()
+	case Status:
+		printStatus(flag.Args()[1:], configure(*config, j8a), auth)
+	case Manifests:
+		printManifests(flag.Args()[1:])
 	}
 
 }
@@ -53,6 +87,140 @@ func main() {
 func printUsage() {
 	printVersion()
 	flag.PrintDefaults()
+	fmt.Printf("\ncommands:\n  status [-o table|json]\tsummarise controller, j8a fleet and routed ingresses\n")
+	fmt.Printf("  manifests [-namespace ns] [-image img]\tprint the install bundle for kubectl apply -f\n")
+}
+
+func printStatus(args []string, s *server.Server, auth *server.Auth) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	o := fs.String("o", "table", "output format, one of table|json")
+	authFlags(fs, auth)
+	fs.Parse(args)
+
+	s.Kube.Auth = auth
+	st, e := s.Status(context.Background())
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "unable to collect status, cause: %v\n", e)
+		os.Exit(-1)
+	}
+	switch *o {
+	case "json":
+		st.JSON(os.Stdout)
+	default:
+		st.Table(os.Stdout)
+	}
+}
+
+func printManifests(args []string) {
+	i := server.NewInstall()
+	fs := flag.NewFlagSet("manifests", flag.ExitOnError)
+	fs.StringVar(&i.Namespace, "namespace", i.Namespace, "namespace for the controller deployment and serviceaccount")
+	fs.StringVar(&i.Image, "image", i.Image, "container image for the controller deployment")
+	featureFlags(fs, &i.Features)
+	fs.Parse(args)
+
+	if e := i.YAML(os.Stdout); e != nil {
+		fmt.Fprintf(os.Stderr, "unable to render manifests, cause: %v\n", e)
+		os.Exit(-1)
+	}
+}
+
+func configure(path string, flags func() (*server.J8a, error)) *server.Server {
+	s := server.NewServer()
+	j, e := flags()
+	if e == nil {
+		e = s.Configure(path, os.LookupEnv, j)
+	}
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "unable to configure, cause: %v\n", e)
+		os.Exit(-1)
+	}
+	return s
+}
+
+// j8aFlags registers flags for all j8a settings with defaults for usage. The returned func builds the settings from
+// flags that were actually passed, so they override config file and env only when present.
+func j8aFlags(fs *flag.FlagSet) func() (*server.J8a, error) {
+	d := server.NewJ8a("")
+	version := fs.String("j8a-version", d.Version, "j8a version for the deployment")
+	image := fs.String("j8a-image", d.Image, "j8a container image without tag")
+	digest := fs.String("j8a-digest", d.Digest, "pin the j8a image to a digest, i.e. sha256:...")
+	namespace := fs.String("j8a-namespace", d.Namespace, "namespace for j8a")
+	ingressClass := fs.String("ingress-class", d.IngressClass, "name of the ingressClass served by j8a")
+	service := fs.String("j8a-service", d.Service, "name of the j8a loadbalancer service")
+	serviceType := fs.String("j8a-service-type", d.LoadBalancer.Type, "type of the j8a service, one of LoadBalancer|NodePort|ClusterIP")
+	serviceProfile := fs.String("j8a-service-profile", d.LoadBalancer.Profile, "loadbalancer profile, one of aws|gcp|azure|metallb|none")
+	deployment := fs.String("j8a-deployment", d.Deployment.Name, "name of the j8a deployment")
+	replicas := fs.Int("j8a-replicas", d.Deployment.Replicas, "replicas of the j8a deployment")
+	podName := fs.String("j8a-pod-name", d.Pod.Name, "name of the j8a container")
+	podLabel := fs.String("j8a-pod-label", "app=j8a", "labels of j8a pods as key=value,key=value")
+	adopt := fs.Bool("j8a-adopt", false, "take over existing j8a objects that are not labelled as owned by the fleet")
+
+	return func() (*server.J8a, error) {
+		j := &server.J8a{}
+		if isFlagPassed("j8a-version") {
+			j.Version = *version
+		}
+		if isFlagPassed("j8a-image") {
+			j.Image = *image
+		}
+		if isFlagPassed("j8a-digest") {
+			j.Digest = *digest
+		}
+		if isFlagPassed("j8a-namespace") {
+			j.Namespace = *namespace
+		}
+		if isFlagPassed("ingress-class") {
+			j.IngressClass = *ingressClass
+		}
+		if isFlagPassed("j8a-service") {
+			j.Service = *service
+		}
+		if isFlagPassed("j8a-service-type") {
+			j.LoadBalancer.Type = *serviceType
+		}
+		if isFlagPassed("j8a-service-profile") {
+			j.LoadBalancer.Profile = *serviceProfile
+		}
+		if isFlagPassed("j8a-deployment") {
+			j.Deployment.Name = *deployment
+		}
+		if isFlagPassed("j8a-replicas") {
+			j.Deployment.Replicas = *replicas
+		}
+		if isFlagPassed("j8a-pod-name") {
+			j.Pod.Name = *podName
+		}
+		if isFlagPassed("j8a-adopt") {
+			j.Adopt = *adopt
+		}
+		if isFlagPassed("j8a-pod-label") {
+			l, e := server.ParseLabels(*podLabel)
+			if e != nil {
+				return nil, fmt.Errorf("invalid -j8a-pod-label, cause: %v", e)
+			}
+			j.Pod.Label = l
+		}
+		return j, nil
+	}
+}
+
+func featureFlags(fs *flag.FlagSet, f *server.Features) {
+	fs.BoolVar(&f.Events, "events", f.Events, "record kubernetes events for ingress resources")
+	fs.BoolVar(&f.LeaderElection, "leader-elect", f.LeaderElection, "elect a leader among controller replicas using a lease")
+	fs.BoolVar(&f.ValidateUpgrades, "j8a-validate-upgrades", f.ValidateUpgrades, "validate config with the j8a binary of a new image in a job before upgrading")
+	fs.BoolVar(&f.NetworkPolicy, "j8a-network-policy", f.NetworkPolicy, "restrict j8a pods with a NetworkPolicy to 80/443 in and DNS and routed services out")
+	fs.BoolVar(&f.ACME, "acme", f.ACME, "issue certificates of acme hosts in the controller and answer their http-01 challenges")
+	fs.BoolVar(&f.ConfigFile, "j8a-config-file", f.ConfigFile, "mount j8a config as a file from a secret instead of the J8ACFG_YML env var")
+}
+
+func authFlags(fs *flag.FlagSet, a *server.Auth) {
+	fs.StringVar(&a.Kubeconfig, "kubeconfig", a.Kubeconfig, "path to a kubeconfig file, authenticates external instead of in-cluster")
+	fs.StringVar(&a.Context, "context", a.Context, "kubeconfig context to use, authenticates external instead of in-cluster")
+	fs.StringVar(&a.Master, "master", a.Master, "address of the kubernetes apiserver, overrides any value in kubeconfig")
+	fs.Float64Var(&a.QPS, "kube-qps", a.QPS, "maximum queries per second to the kubernetes apiserver")
+	fs.IntVar(&a.Burst, "kube-burst", a.Burst, "maximum burst of queries to the kubernetes apiserver")
+	fs.StringVar(&a.UserAgent, "user-agent", a.UserAgent, "user agent sent to the kubernetes apiserver")
 }
 
 func printVersion() {
@@ -76,22 +244,3 @@ func recovery() {
 		os.Exit(-1)
 	}
 }
-
-func waitForSignal() {
-	defer recovery()
-	sig := interruptChannel()
-	for {
-		select {
-		case <-sig:
-			panic("os signal")
-		default:
-			time.Sleep(time.Second * 1)
-		}
-	}
-}
-
-func interruptChannel() chan os.Signal {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT)
-	return sigs
-}
@@ -22,7 +22,7 @@ func TestFetchBackendServicePort(t *testing.T) {
 
 	s := server.NewServer()
 
-	got, _ := s.FetchBackendServicePort(i.Spec.Rules[0].HTTP.Paths[0].Backend)
+	got, _ := s.FetchBackendServicePort(context.TODO(), i.Spec.Rules[0].HTTP.Paths[0].Backend)
 	want := "80"
 	if got != want {
 		t.Errorf("port not extracted, got %v want %v", got, want)
@@ -0,0 +1,7 @@
+// Package resources bundles files the controller needs at runtime, the image only ships the binary.
+package resources
+
+import _ "embed"
+
+//go:embed j8a/configtemplate.yml
+var J8aConfigTemplate string
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"io"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AcmeAnnotation turns j8a's acme mode on or off for the spec.tls hosts without secret of one ingress.
+const AcmeAnnotation = annotationPrefix + "acme"
+
+// ACME lets j8a obtain certificates for a fleet from an acme provider such as letsencrypt.
+type ACME struct {
+	Email    string `json:"email,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	// Enabled applies acme to all ingress of the fleet unless they opt out with the annotation.
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// acme certs are shared through this secret once issued, so replicas and restarts do not request new ones.
+// renewal starts when the shared cert gets this close to expiry.
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+const (
+	// acmeChallengePath of acme hosts is routed by j8a to the solver of the controller.
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeSolverPort    = 8089
+	acmeAccountSecret = "acme-account"
+	acmeAccountKey    = "account.key"
+	// acmeOrderTimeout bounds one order including all http-01 validations.
+	acmeOrderTimeout = 5 * time.Minute
+	// acmeRetryAfter keeps a failed order of the same domains from running into provider rate limits.
+	acmeRetryAfter = time.Hour
+)
+
+var acmeDirectories = map[string]string{
+	"letsencrypt":         "https://acme-v02.api.letsencrypt.org/directory",
+	"letsencrypt-staging": "https://acme-staging-v02.api.letsencrypt.org/directory",
+}
+
+// Acme is the acme client of the controller. It orders certificates for all fleets with one account, whose key is
+// kept in a secret in the controller namespace. Every replica answers http-01 challenges from that key, so the
+// service of the controller can send them to any replica.
+type Acme struct {
+	Namespace string
+	Service   string
+	Addr      string
+	http      *http.Client
+	lock      sync.Mutex
+	key       *ecdsa.PrivateKey
+}
+
+func NewAcme() *Acme {
+	ns := os.Getenv(leaseNamespaceEnv)
+	if len(ns) == 0 {
+		ns = "default"
+	}
+	return &Acme{
+		Namespace: ns,
+		Service:   installName,
+		Addr:      fmt.Sprintf(":%v", acmeSolverPort),
+		http:      http.DefaultClient,
+	}
+}
+
+// acmeState tracks the order of a fleet, which runs in the background while reconcile goes on.
+type acmeState struct {
+	lock    sync.Mutex
+	pending bool
+	retry   map[string]time.Time
+}
+
+func (j *J8a) acmeSecretName() string {
+	return "acme-" + j.IngressClass
+}
+
+// directory is the acme directory url of the provider, letsencrypt by default, or the provider itself if it is a url.
+func (a *ACME) directory() (string, error) {
+	p := a.Provider
+	if len(p) == 0 {
+		p = "letsencrypt"
+	}
+	if d, ok := acmeDirectories[p]; ok {
+		return d, nil
+	}
+	if strings.HasPrefix(p, "https://") {
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown acme provider '%v', want letsencrypt, letsencrypt-staging or a directory url", p)
+}
+
+// acmeFor decides if the spec.tls hosts without secret of an ingress use acme. Opting in, by annotation or for the
+// whole fleet, needs a fleet with an acme email, providers won't issue without one.
+func (j *J8a) acmeFor(annotations map[string]string) (bool, error) {
+	b := j.ACME != nil && j.ACME.Enabled
+	if v, ok := annotations[AcmeAnnotation]; ok {
+		var e error
+		if b, e = strconv.ParseBool(v); e != nil {
+			return false, fmt.Errorf("invalid annotation '%v', want true or false, got '%v'", AcmeAnnotation, v)
+		}
+	}
+	if b && (j.ACME == nil || len(j.ACME.Email) == 0) {
+		return false, fmt.Errorf("acme needs an email configured for fleet '%v'", j)
+	}
+	return b, nil
+}
+
+// acmeDomains collects the hosts of all routes served with acme, sorted so the config hash is stable.
+func acmeDomains(routes []Route) []string {
+	seen := make(map[string]bool)
+	d := make([]string, 0)
+	for _, r := range routes {
+		if r.ACME && len(r.Host) > 0 && !seen[r.Host] {
+			seen[r.Host] = true
+			d = append(d, r.Host)
+		}
+	}
+	sort.Strings(d)
+	return d
+}
+
+// fetchAcmeCertificate returns the shared acme certificate of the fleet if it covers all domains at time at.
+func (s *Server) fetchAcmeCertificate(ctx context.Context, f *J8a, domains []string, at time.Time) *Certificate {
+	sec, e := s.getSecret(ctx, f.Namespace, f.acmeSecretName())
+	if e != nil {
+		return nil
+	}
+	c, e := parseTLSSecret(sec)
+	if e != nil {
+		s.Log.Errorf("ignoring acme secret, cause: %v", e)
+		return nil
+	}
+	if !c.Covers(at, domains...) {
+		return nil
+	}
+	return c
+}
+
+// acmeRoutes send the challenge path of every acme host to the solver of the controller.
+func (s *Server) acmeRoutes(routes []Route) []Route {
+	acme := make([]Route, 0)
+	if !s.Features.ACME {
+		return acme
+	}
+	host := fmt.Sprintf("%v.%v.svc.cluster.local", s.Acme.Service, s.Acme.Namespace)
+	for _, d := range acmeDomains(routes) {
+		acme = append(acme, *NewRouteFrom(acmeChallengePath, d, nil, "").WithUpstream(host, fmt.Sprint(acmeSolverPort)))
+	}
+	return acme
+}
+
+// issueAcmeCertificate orders a certificate for the acme hosts of the fleet once its config, with the challenge
+// routes, rolled out, and again before it expires. The order runs in the background and stores the certificate in
+// the shared acme secret, the next reconcile serves it. A failed order of the same hosts is retried after an hour.
+func (s *Server) issueAcmeCertificate(ctx context.Context, f *J8a) {
+	domains := acmeDomains(f.routes())
+	if len(domains) == 0 || f.ACME == nil || f.rollout != nil {
+		return
+	}
+	if !s.Features.ACME {
+		s.Log.Errorf("unable to issue acme certificate for %v, acme is not enabled on the controller", domains)
+		return
+	}
+	if s.fetchAcmeCertificate(ctx, f, domains, time.Now().Add(acmeRenewBefore)) != nil {
+		return
+	}
+	key := strings.Join(domains, ",")
+	f.acme.lock.Lock()
+	defer f.acme.lock.Unlock()
+	if f.acme.pending || time.Now().Before(f.acme.retry[key]) {
+		return
+	}
+	f.acme.pending = true
+	s.Log.Infof("ordering acme certificate for %v", domains)
+	go func() {
+		octx, cancel := context.WithTimeout(ctx, acmeOrderTimeout)
+		defer cancel()
+		e := s.orderAcmeCertificate(octx, f, domains)
+		f.acme.lock.Lock()
+		defer f.acme.lock.Unlock()
+		f.acme.pending = false
+		if e != nil {
+			f.acme.retry[key] = time.Now().Add(acmeRetryAfter)
+			s.Log.Errorf("unable to issue acme certificate for %v, retrying after %v, cause: %v", domains, acmeRetryAfter, e)
+			return
+		}
+		s.Log.Infof("issued acme certificate for %v to secret '%v/%v'", domains, f.Namespace, f.acmeSecretName())
+	}()
+}
+
+func (s *Server) orderAcmeCertificate(ctx context.Context, f *J8a, domains []string) error {
+	dir, e := f.ACME.directory()
+	if e != nil {
+		return e
+	}
+	key, e := s.acmeAccountKey(ctx, true)
+	if e != nil {
+		return e
+	}
+	c := &acme.Client{Key: key, DirectoryURL: dir, HTTPClient: s.Acme.http, UserAgent: "ingress-j8a/" + s.Version}
+	chain, certKey, e := acmeOrder(ctx, c, f.ACME.Email, domains)
+	if e != nil {
+		return e
+	}
+	return s.storeAcmeCertificate(ctx, f, chain, certKey)
+}
+
+// acmeOrder registers the account if needed, solves the http-01 challenge of every domain and returns the pem
+// encoded chain and private key of the issued certificate.
+func acmeOrder(ctx context.Context, c *acme.Client, email string, domains []string) (string, string, error) {
+	_, e := c.Register(ctx, &acme.Account{Contact: []string{"mailto:" + email}}, acme.AcceptTOS)
+	if e != nil && e != acme.ErrAccountAlreadyExists {
+		return "", "", fmt.Errorf("unable to register acme account, cause: %v", e)
+	}
+	o, e := c.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if e != nil {
+		return "", "", fmt.Errorf("unable to create acme order, cause: %v", e)
+	}
+	//later responses to the order may not carry its url.
+	orderURL := o.URI
+	for _, u := range o.AuthzURLs {
+		z, e := c.GetAuthorization(ctx, u)
+		if e != nil {
+			return "", "", fmt.Errorf("unable to fetch acme authorization, cause: %v", e)
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, ch := range z.Challenges {
+			if ch.Type == "http-01" {
+				chal = ch
+			}
+		}
+		if chal == nil {
+			return "", "", fmt.Errorf("no http-01 challenge offered for '%v'", z.Identifier.Value)
+		}
+		if _, e := c.Accept(ctx, chal); e != nil {
+			return "", "", fmt.Errorf("unable to accept acme challenge for '%v', cause: %v", z.Identifier.Value, e)
+		}
+		if _, e := c.WaitAuthorization(ctx, z.URI); e != nil {
+			return "", "", fmt.Errorf("acme challenge for '%v' failed, cause: %v", z.Identifier.Value, e)
+		}
+	}
+	if o, e = c.WaitOrder(ctx, orderURL); e != nil {
+		return "", "", fmt.Errorf("acme order not ready, cause: %v", e)
+	}
+
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		return "", "", e
+	}
+	csr, e := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if e != nil {
+		return "", "", fmt.Errorf("unable to create certificate request, cause: %v", e)
+	}
+	ders, _, e := c.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if e != nil {
+		//a ca that issues in the background may answer finalize without the order location the client waits on,
+		//the order is then awaited by its own url.
+		vo, we := c.WaitOrder(ctx, orderURL)
+		if we != nil || vo.Status != acme.StatusValid {
+			return "", "", fmt.Errorf("unable to finalize acme order, cause: %v", e)
+		}
+		if ders, e = c.FetchCert(ctx, vo.CertURL, true); e != nil {
+			return "", "", fmt.Errorf("unable to download acme certificate, cause: %v", e)
+		}
+	}
+	var chain []byte
+	for _, der := range ders {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	kd, e := x509.MarshalECPrivateKey(key)
+	if e != nil {
+		return "", "", e
+	}
+	return string(chain), string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kd})), nil
+}
+
+func (s *Server) storeAcmeCertificate(ctx context.Context, f *J8a, chain string, key string) error {
+	secretsClient := s.Kube.Client.CoreV1().Secrets(f.Namespace)
+	sec, e := secretsClient.Get(ctx, f.acmeSecretName(), metav1.GetOptions{})
+	if errors.IsNotFound(e) {
+		sec = &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: f.acmeSecretName(), Namespace: f.Namespace},
+			Type:       apiv1.SecretTypeTLS,
+		}
+		s.stamp(sec, f, false)
+		sec.Data = map[string][]byte{apiv1.TLSCertKey: []byte(chain), apiv1.TLSPrivateKeyKey: []byte(key)}
+		_, e = secretsClient.Create(ctx, sec, metav1.CreateOptions{})
+	} else if e == nil {
+		s.stamp(sec, f, false)
+		sec.Data = map[string][]byte{apiv1.TLSCertKey: []byte(chain), apiv1.TLSPrivateKeyKey: []byte(key)}
+		_, e = secretsClient.Update(ctx, sec, metav1.UpdateOptions{})
+	}
+	if e != nil {
+		return fmt.Errorf("unable to store acme certificate in secret '%v/%v', cause: %v", f.Namespace, f.acmeSecretName(), e)
+	}
+	return nil
+}
+
+// acmeAccountKey loads the account key from its secret, and creates it if asked to. Only the leader orders and
+// creates, the other replicas read it to answer challenges.
+func (s *Server) acmeAccountKey(ctx context.Context, create bool) (*ecdsa.PrivateKey, error) {
+	a := s.Acme
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.key != nil {
+		return a.key, nil
+	}
+	secretsClient := s.Kube.Client.CoreV1().Secrets(a.Namespace)
+	sec, e := secretsClient.Get(ctx, acmeAccountSecret, metav1.GetOptions{})
+	if e == nil {
+		b, _ := pem.Decode(sec.Data[acmeAccountKey])
+		if b == nil {
+			return nil, fmt.Errorf("secret '%v/%v' has no pem %v", a.Namespace, acmeAccountSecret, acmeAccountKey)
+		}
+		if a.key, e = x509.ParseECPrivateKey(b.Bytes); e != nil {
+			return nil, fmt.Errorf("invalid acme account key in secret '%v/%v', cause: %v", a.Namespace, acmeAccountSecret, e)
+		}
+		return a.key, nil
+	}
+	if !errors.IsNotFound(e) || !create {
+		return nil, fmt.Errorf("unable to fetch acme account key, cause: %v", e)
+	}
+
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		return nil, e
+	}
+	der, e := x509.MarshalECPrivateKey(key)
+	if e != nil {
+		return nil, e
+	}
+	sec = &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: acmeAccountSecret, Namespace: a.Namespace, Labels: map[string]string{
+			ManagedByLabel: managedBy,
+		}},
+		Data: map[string][]byte{acmeAccountKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})},
+	}
+	if _, e := secretsClient.Create(ctx, sec, metav1.CreateOptions{}); e != nil {
+		return nil, fmt.Errorf("unable to store acme account key in secret '%v/%v', cause: %v", a.Namespace, acmeAccountSecret, e)
+	}
+	a.key = key
+	return key, nil
+}
+
+// acmeSolver answers http-01 challenges with the key authorization of the account.
+func (s *Server) acmeSolver() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+		if !strings.HasPrefix(r.URL.Path, acmeChallengePath) || len(token) == 0 || strings.Contains(token, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		key, e := s.acmeAccountKey(r.Context(), false)
+		if e != nil {
+			s.Log.Errorf("unable to answer acme challenge for host '%v', cause: %v", r.Host, e)
+			http.NotFound(w, r)
+			return
+		}
+		ka, e := (&acme.Client{Key: key}).HTTP01ChallengeResponse(token)
+		if e != nil {
+			s.Log.Errorf("unable to answer acme challenge for host '%v', cause: %v", r.Host, e)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, ka)
+	})
+}
+
+// serveAcmeSolver answers acme challenges until ctx is done, nothing happens unless acme is enabled.
+func (s *Server) serveAcmeSolver(ctx context.Context) {
+	if !s.Features.ACME || len(s.Acme.Addr) == 0 {
+		return
+	}
+	hs := &http.Server{Addr: s.Acme.Addr, Handler: s.acmeSolver()}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+	go func() {
+		s.Log.Infof("answering acme challenges on %v%v", s.Acme.Addr, acmeChallengePath)
+		if e := hs.ListenAndServe(); e != nil && e != http.ErrServerClosed {
+			s.Log.Errorf("unable to answer acme challenges, cause: %v", e)
+		}
+	}()
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func acmeIngress(f *J8a, host string) *netv1.Ingress {
+	igrs := ingressFor("acme", f.IngressClass, netv1.ServiceBackendPort{Number: 80})
+	igrs.Spec.Rules[0].Host = host
+	igrs.Spec.TLS = []netv1.IngressTLS{{Hosts: []string{host}}}
+	return igrs
+}
+
+func TestAcmeFor(t *testing.T) {
+	f := NewJ8a("")
+	if _, e := f.acmeFor(map[string]string{AcmeAnnotation: "true"}); e == nil {
+		t.Errorf("should reject acme without fleet email")
+	}
+	f.ACME = &ACME{Enabled: true}
+	if _, e := f.acmeFor(nil); e == nil {
+		t.Errorf("should reject fleet acme without email")
+	}
+	f.ACME = &ACME{Email: "ops@example.com"}
+	if on, _ := f.acmeFor(nil); on {
+		t.Errorf("acme should be opt in unless enabled for the fleet")
+	}
+	if on, e := f.acmeFor(map[string]string{AcmeAnnotation: "true"}); !on || e != nil {
+		t.Errorf("acme should be enabled by annotation, got %v", e)
+	}
+	f.ACME.Enabled = true
+	if on, _ := f.acmeFor(map[string]string{AcmeAnnotation: "false"}); on {
+		t.Errorf("ingress should opt out of fleet acme")
+	}
+}
+
+func TestRenderAcme(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	s.Features.ACME = true
+	f := s.Fleets[0]
+	f.ACME = &ACME{Email: "ops@example.com", Enabled: true}
+
+	s.updateCacheFromIngressList(context.TODO(), &netv1.IngressList{Items: []netv1.Ingress{*acmeIngress(f, "www.example.com")}})
+	challenge := f.routes()[0]
+	if challenge.Path != acmeChallengePath || challenge.Host != "www.example.com" ||
+		challenge.Upstream.Host != "ingress-j8a.default.svc.cluster.local" || challenge.Upstream.Port != "8089" {
+		t.Errorf("should route acme challenges of host to the controller, got %+v", challenge)
+	}
+	if tls := s.renderTLS(context.TODO(), f, f.routes()); len(tls) > 0 {
+		t.Errorf("should not serve tls before acme certificate is issued, got\n%v", tls)
+	}
+
+	//a shared certificate is used as soon as it covers all acme domains.
+	s.Kube.Client.CoreV1().Secrets(f.Namespace).Create(context.TODO(),
+		tlsSecret(t, f.Namespace, f.acmeSecretName(), time.Now().Add(60*24*time.Hour), "www.example.com"), metav1.CreateOptions{})
+	tls := s.renderTLS(context.TODO(), f, f.routes())
+	if strings.Contains(tls, "acme:") || !strings.Contains(tls, "BEGIN CERTIFICATE") {
+		t.Errorf("tls should serve shared acme certificate, got\n%v", tls)
+	}
+	c, e := renderJ8aConfig(f, tls)
+	if e != nil {
+		t.Fatalf("should render config, got %v", e)
+	}
+	m := make(map[string]interface{})
+	if e := yaml.Unmarshal([]byte(c), &m); e != nil {
+		t.Errorf("rendered config with certificate should be yaml, got %v\n%v", e, c)
+	}
+}
+
+func TestAcmeProvider(t *testing.T) {
+	for p, want := range map[string]string{
+		"":                             acmeDirectories["letsencrypt"],
+		"letsencrypt-staging":          acmeDirectories["letsencrypt-staging"],
+		"https://acme.example.com/dir": "https://acme.example.com/dir",
+	} {
+		if d, e := (&ACME{Provider: p}).directory(); e != nil || d != want {
+			t.Errorf("provider '%v' want directory %v, got %v %v", p, want, d, e)
+		}
+	}
+	if _, e := (&ACME{Provider: "zerossl"}).directory(); e == nil {
+		t.Errorf("should reject unknown provider")
+	}
+}
+
+// pebble runs the pebble acme test server, https://github.com/letsencrypt/pebble, which validates http-01 challenges
+// against localhost on httpPort. Tests are skipped unless the pebble binary is on the PATH.
+type pebble struct {
+	dir    string
+	client *http.Client
+	orders int32
+}
+
+// countOrders counts new orders sent to pebble.
+type countOrders struct {
+	http.RoundTripper
+	orders *int32
+}
+
+func (c countOrders) RoundTrip(r *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(r.URL.Path, "/order-plz") {
+		atomic.AddInt32(c.orders, 1)
+	}
+	return c.RoundTripper.RoundTrip(r)
+}
+
+func freePort(t *testing.T) int {
+	l, e := net.Listen("tcp", "localhost:0")
+	if e != nil {
+		t.Fatalf("unable to find free port, cause: %v", e)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startPebble(t *testing.T, httpPort int) *pebble {
+	bin, e := exec.LookPath("pebble")
+	if e != nil {
+		t.Skip("pebble not on PATH, skipping acme test")
+	}
+	tmp := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	kd, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(tmp, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(tmp, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kd}), 0600)
+
+	listen := fmt.Sprintf("localhost:%v", freePort(t))
+	config, _ := json.Marshal(map[string]interface{}{"pebble": map[string]interface{}{
+		"listenAddress":           listen,
+		"managementListenAddress": fmt.Sprintf("localhost:%v", freePort(t)),
+		"certificate":             filepath.Join(tmp, "cert.pem"),
+		"privateKey":              filepath.Join(tmp, "key.pem"),
+		"httpPort":                httpPort,
+		"tlsPort":                 freePort(t),
+		"retryAfter":              map[string]int{"authz": 1, "order": 1},
+	}})
+	os.WriteFile(filepath.Join(tmp, "pebble.json"), config, 0600)
+
+	cmd := exec.Command(bin, "-config", filepath.Join(tmp, "pebble.json"))
+	cmd.Env = append(os.Environ(), "PEBBLE_VA_NOSLEEP=1", "PEBBLE_WFE_NONCEREJECT=0")
+	if e := cmd.Start(); e != nil {
+		t.Fatalf("unable to start pebble, cause: %v", e)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	ca, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	p := &pebble{dir: "https://" + listen + "/dir"}
+	p.client = &http.Client{Transport: countOrders{
+		RoundTripper: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		orders:       &p.orders,
+	}}
+	for i := 0; ; i++ {
+		r, e := p.client.Get(p.dir)
+		if e == nil {
+			r.Body.Close()
+			return p
+		}
+		if i == 100 {
+			t.Fatalf("pebble did not start, cause: %v", e)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// serveSolver answers http-01 challenges with h on all interfaces, pebble may resolve localhost to ipv4 or ipv6.
+func serveSolver(t *testing.T, h http.Handler) int {
+	l, e := net.Listen("tcp", ":0")
+	if e != nil {
+		t.Fatalf("unable to listen for acme challenges, cause: %v", e)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func awaitAcmeOrder(t *testing.T, f *J8a) {
+	for i := 0; i < 3000; i++ {
+		f.acme.lock.Lock()
+		pending := f.acme.pending
+		f.acme.lock.Unlock()
+		if !pending {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("acme order did not finish")
+}
+
+func TestIssueAcmeCertificate(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	s.Features.ACME = true
+	ctx := context.TODO()
+	a := startPebble(t, serveSolver(t, s.acmeSolver()))
+	s.Acme.http = a.client
+	f := s.Fleets[0]
+	f.ACME = &ACME{Email: "ops@example.com", Enabled: true, Provider: a.dir}
+
+	//before an account exists there is nothing to answer challenges with.
+	rec := httptest.NewRecorder()
+	s.acmeSolver().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost"+acmeChallengePath+"t", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("solver should not answer without account, got %v", rec.Code)
+	}
+
+	s.updateCacheFromIngressList(ctx, &netv1.IngressList{Items: []netv1.Ingress{*acmeIngress(f, "localhost")}})
+	s.issueAcmeCertificate(ctx, f)
+	awaitAcmeOrder(t, f)
+
+	sec, e := s.Kube.Client.CoreV1().Secrets(f.Namespace).Get(ctx, f.acmeSecretName(), metav1.GetOptions{})
+	if e != nil {
+		t.Fatalf("should store issued certificate in shared secret, got %v", e)
+	}
+	c, e := parseTLSSecret(sec)
+	if e != nil || !c.Covers(time.Now().Add(acmeRenewBefore), "localhost") || sec.Labels[ManagedByLabel] != managedBy {
+		t.Errorf("shared secret should hold a certificate for the host, got %v %v", e, sec.Labels)
+	}
+	if _, e := s.Kube.Client.CoreV1().Secrets(s.Acme.Namespace).Get(ctx, acmeAccountSecret, metav1.GetOptions{}); e != nil {
+		t.Errorf("should store acme account key, got %v", e)
+	}
+	if tls := s.renderTLS(ctx, f, f.routes()); !strings.Contains(tls, strings.TrimSpace(indent(string(sec.Data[apiv1.TLSCertKey]), 8))) {
+		t.Errorf("should serve issued certificate, got\n%v", tls)
+	}
+
+	//another replica, or the next start, shares the certificate and does not order again.
+	s.issueAcmeCertificate(ctx, f)
+	awaitAcmeOrder(t, f)
+	if atomic.LoadInt32(&a.orders) != 1 {
+		t.Errorf("should not order a certificate that is still valid, got %v orders", atomic.LoadInt32(&a.orders))
+	}
+}
+
+func TestIssueAcmeCertificateRetry(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	s.Features.ACME = true
+	ctx := context.TODO()
+	//the solver answers nothing, so challenges fail.
+	a := startPebble(t, serveSolver(t, http.NotFoundHandler()))
+	s.Acme.http = a.client
+	f := s.Fleets[0]
+	f.ACME = &ACME{Email: "ops@example.com", Enabled: true, Provider: a.dir}
+
+	s.updateCacheFromIngressList(ctx, &netv1.IngressList{Items: []netv1.Ingress{*acmeIngress(f, "localhost")}})
+	s.issueAcmeCertificate(ctx, f)
+	awaitAcmeOrder(t, f)
+	if _, e := s.Kube.Client.CoreV1().Secrets(f.Namespace).Get(ctx, f.acmeSecretName(), metav1.GetOptions{}); e == nil {
+		t.Errorf("should not store certificate of failed order")
+	}
+	s.issueAcmeCertificate(ctx, f)
+	awaitAcmeOrder(t, f)
+	if atomic.LoadInt32(&a.orders) != 1 {
+		t.Errorf("should back off after failed order, got %v orders", atomic.LoadInt32(&a.orders))
+	}
+}
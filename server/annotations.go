@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ingress annotations for j8a settings the ingress spec cannot express.
+const (
+	annotationPrefix                     = "j8a.io/"
+	ReadTimeoutAnnotation                = annotationPrefix + "read-timeout-seconds"
+	RoundTripTimeoutAnnotation           = annotationPrefix + "round-trip-timeout-seconds"
+	MaxBodyBytesAnnotation               = annotationPrefix + "max-body-bytes"
+	UpstreamSchemeAnnotation             = annotationPrefix + "upstream-scheme"
+	UpstreamInsecureSkipVerifyAnnotation = annotationPrefix + "upstream-tls-insecure-skip-verify"
+)
+
+// RouteSettings override the fleet params for the routes of one ingress, zero values keep the fleet params.
+type RouteSettings struct {
+	ReadTimeoutSeconds      int
+	RoundTripTimeoutSeconds int
+	MaxBodyBytes            int64
+	InsecureSkipVerify      *bool
+}
+
+// parseIngressAnnotations validates all j8a.io annotations of an ingress. Unknown keys in our namespace are
+// rejected so a typo does not silently fall back to the fleet params.
+func parseIngressAnnotations(annotations map[string]string) (RouteSettings, string, error) {
+	rs := RouteSettings{}
+	scheme := "http"
+
+	keys := make([]string, 0)
+	for k := range annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := annotations[k]
+		switch k {
+		case ReadTimeoutAnnotation, RoundTripTimeoutAnnotation:
+			i, e := strconv.Atoi(v)
+			if e != nil || i <= 0 {
+				return rs, scheme, fmt.Errorf("invalid annotation '%v', want positive seconds, got '%v'", k, v)
+			}
+			if k == ReadTimeoutAnnotation {
+				rs.ReadTimeoutSeconds = i
+			} else {
+				rs.RoundTripTimeoutSeconds = i
+			}
+		case MaxBodyBytesAnnotation:
+			i, e := strconv.ParseInt(v, 10, 64)
+			if e != nil || i <= 0 {
+				return rs, scheme, fmt.Errorf("invalid annotation '%v', want positive bytes, got '%v'", k, v)
+			}
+			rs.MaxBodyBytes = i
+		case UpstreamSchemeAnnotation:
+			if v != "http" && v != "https" {
+				return rs, scheme, fmt.Errorf("invalid annotation '%v', want http or https, got '%v'", k, v)
+			}
+			scheme = v
+		case UpstreamInsecureSkipVerifyAnnotation:
+			b, e := strconv.ParseBool(v)
+			if e != nil {
+				return rs, scheme, fmt.Errorf("invalid annotation '%v', want true or false, got '%v'", k, v)
+			}
+			rs.InsecureSkipVerify = &b
+		default:
+			//jwt annotations are validated with the secrets they reference, acme with the fleet
+			if !isJwtAnnotation(k) && k != AcmeAnnotation {
+				return rs, scheme, fmt.Errorf("unknown annotation '%v'", k)
+			}
+		}
+	}
+	return rs, scheme, nil
+}
+
+// withRoutes applies route settings on top of the fleet params. j8a routes carry no timeouts, body size or upstream
+// tls, it applies them to the whole listener, so the fleet renders the most permissive value any of its routes asks
+// for. Routes without an annotation count with the fleet params.
+func (p Params) withRoutes(routes []Route) Params {
+	if len(routes) == 0 {
+		return p
+	}
+	e := p
+	e.UpstreamReadTimeoutSeconds = 0
+	e.DownstreamRoundTripTimeoutSeconds = 0
+	e.MaxBodyBytes = 0
+	for _, r := range routes {
+		rs := r.Settings
+		e.UpstreamReadTimeoutSeconds = max(e.UpstreamReadTimeoutSeconds, orDefault(rs.ReadTimeoutSeconds, p.UpstreamReadTimeoutSeconds))
+		e.DownstreamRoundTripTimeoutSeconds = max(e.DownstreamRoundTripTimeoutSeconds, orDefault(rs.RoundTripTimeoutSeconds, p.DownstreamRoundTripTimeoutSeconds))
+		e.MaxBodyBytes = max64(e.MaxBodyBytes, orDefault64(rs.MaxBodyBytes, p.MaxBodyBytes))
+		if rs.InsecureSkipVerify != nil && *rs.InsecureSkipVerify {
+			e.UpstreamTLSInsecureSkipVerify = true
+		}
+	}
+	return e
+}
+
+func orDefault(v int, d int) int {
+	if v > 0 {
+		return v
+	}
+	return d
+}
+
+func orDefault64(v int64, d int64) int64 {
+	if v > 0 {
+		return v
+	}
+	return d
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
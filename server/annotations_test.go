@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	netv1 "k8s.io/api/networking/v1"
+	"strings"
+	"testing"
+)
+
+func TestParseIngressAnnotations(t *testing.T) {
+	rs, scheme, e := parseIngressAnnotations(map[string]string{
+		ReadTimeoutAnnotation:                "30",
+		MaxBodyBytesAnnotation:               "10485760",
+		UpstreamSchemeAnnotation:             "https",
+		UpstreamInsecureSkipVerifyAnnotation: "false",
+		"kubernetes.io/ingress.class":        "ingress-j8a",
+	})
+	if e != nil {
+		t.Fatalf("should parse annotations, got %v", e)
+	}
+	if rs.ReadTimeoutSeconds != 30 || rs.MaxBodyBytes != 10485760 || rs.RoundTripTimeoutSeconds != 0 {
+		t.Errorf("unexpected route settings %+v", rs)
+	}
+	if scheme != "https" || rs.InsecureSkipVerify == nil || *rs.InsecureSkipVerify {
+		t.Errorf("unexpected upstream scheme %v or tls settings %+v", scheme, rs)
+	}
+
+	for _, bad := range []map[string]string{
+		{RoundTripTimeoutAnnotation: "0"},
+		{MaxBodyBytesAnnotation: "1MB"},
+		{UpstreamSchemeAnnotation: "grpc"},
+		{UpstreamInsecureSkipVerifyAnnotation: "yes please"},
+		{"j8a.io/read-timeout": "5"},
+	} {
+		if _, _, e := parseIngressAnnotations(bad); e == nil {
+			t.Errorf("should reject annotations %v", bad)
+		}
+	}
+}
+
+func TestParamsWithRoutes(t *testing.T) {
+	p := DefaultParams()
+	p.UpstreamTLSInsecureSkipVerify = false
+	skip := true
+	got := p.withRoutes([]Route{
+		{Settings: RouteSettings{ReadTimeoutSeconds: 300}},
+		{Settings: RouteSettings{MaxBodyBytes: 1024, InsecureSkipVerify: &skip}},
+	})
+	if got.UpstreamReadTimeoutSeconds != 300 {
+		t.Errorf("want largest read timeout 300, got %v", got.UpstreamReadTimeoutSeconds)
+	}
+	if got.MaxBodyBytes != p.MaxBodyBytes {
+		t.Errorf("route without override should keep fleet max body bytes, got %v", got.MaxBodyBytes)
+	}
+	if !got.UpstreamTLSInsecureSkipVerify {
+		t.Errorf("any route skipping verification should skip for the fleet")
+	}
+
+	got = p.withRoutes([]Route{{Settings: RouteSettings{RoundTripTimeoutSeconds: 10}}})
+	if got.DownstreamRoundTripTimeoutSeconds != 10 {
+		t.Errorf("annotation should override fleet round trip timeout, got %v", got.DownstreamRoundTripTimeoutSeconds)
+	}
+}
+
+func TestTranslateIngressAnnotations(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+
+	igrs := ingressFor("a", f.IngressClass, netv1.ServiceBackendPort{Number: 443})
+	igrs.Annotations = map[string]string{UpstreamSchemeAnnotation: "https", ReadTimeoutAnnotation: "45"}
+	routes, e := s.translateIngress(context.TODO(), *igrs)
+	if e != nil {
+		t.Fatalf("should translate ingress, got %v", e)
+	}
+	if routes[0].Upstream.Scheme != "https" || routes[0].Settings.ReadTimeoutSeconds != 45 {
+		t.Errorf("route should carry annotations, got %+v", routes[0])
+	}
+
+	s.updateCacheFromIngressList(context.TODO(), &netv1.IngressList{Items: []netv1.Ingress{*igrs}})
+	c, e := renderJ8aConfig(f, "")
+	if e != nil || !strings.Contains(c, "readTimeoutSeconds: 45") {
+		t.Errorf("fleet should render the annotated read timeout, got %v\n%v", e, c)
+	}
+
+	igrs.Annotations[ReadTimeoutAnnotation] = "forever"
+	if _, e := s.translateIngress(context.TODO(), *igrs); e == nil {
+		t.Errorf("should reject ingress with invalid annotation")
+	}
+}
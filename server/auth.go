@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Auth configures how the controller talks to the apiserver. In-cluster serviceaccount credentials are the
+// default, any of Kubeconfig, Context or Master switches to external authentication.
+type Auth struct {
+	Kubeconfig string
+	Context    string
+	Master     string
+	QPS        float64
+	Burst      int
+	UserAgent  string
+}
+
+func NewAuth() *Auth {
+	return &Auth{
+		QPS:       20,
+		Burst:     30,
+		UserAgent: "ingress-j8a/" + Version,
+	}
+}
+
+func (a *Auth) external() bool {
+	return len(a.Kubeconfig) > 0 || len(a.Context) > 0 || len(a.Master) > 0
+}
+
+// authenticate keeps a client that was provided by an embedding program, otherwise it creates one.
+func (s *Server) authenticate(ctx context.Context) error {
+	if s.Kube.Client != nil {
+		s.Log.Info("using provided kubernetes client")
+		return nil
+	}
+	return s.authenticateToKube(ctx)
+}
+
+func (s *Server) authenticateToKube(ctx context.Context) error {
+	if s.Kube.Auth.external() {
+		return s.authenticateToKubeExternal(ctx)
+	}
+	return s.authenticateToKubeInternal(ctx)
+}
+
+func (s *Server) authenticateToKubeExternal(ctx context.Context) error {
+	const extErrMsg = "unable to authenticate external to kubernetes control plane using kubeconfig '%v', cause: %v"
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if len(s.Kube.Auth.Kubeconfig) > 0 {
+		rules.ExplicitPath = s.Kube.Auth.Kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: s.Kube.Auth.Context,
+	}
+	if len(s.Kube.Auth.Master) > 0 {
+		overrides.ClusterInfo.Server = s.Kube.Auth.Master
+	}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return fmt.Errorf(extErrMsg, s.Kube.Auth.Kubeconfig, err)
+	}
+	if err = s.connect(ctx, config, "external"); err != nil {
+		return fmt.Errorf(extErrMsg, s.Kube.Auth.Kubeconfig, err)
+	}
+	return nil
+}
+
+func (s *Server) authenticateToKubeInternal(ctx context.Context) error {
+	const intErrMsg = "unable to authenticate internal to kubernetes control plane running at %v, cause: %v"
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf(intErrMsg, "'undefined'", err)
+	}
+	if err = s.connect(ctx, config, "internal"); err != nil {
+		return fmt.Errorf(intErrMsg, config.Host, err)
+	}
+	return nil
+}
+
+// connect applies client tuning to the rest config and proves the credentials by reading the apiserver's own service.
+func (s *Server) connect(ctx context.Context, config *rest.Config, mode string) error {
+	config.QPS = float32(s.Kube.Auth.QPS)
+	config.Burst = s.Kube.Auth.Burst
+	config.UserAgent = s.Kube.Auth.UserAgent
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	apiserver, err := clientset.CoreV1().Services("default").Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	s.Kube.Config = config
+	s.Kube.Client = clientset
+	s.Log.Infof("authenticated %v to kubernetes control plane running at %v uid: %v", mode, config.Host, apiserver.ObjectMeta.UID)
+	return nil
+}
@@ -34,7 +34,15 @@ func (c *Cache) update(data interface{}) {
 	switch data.(type) {
 	case []Route:
 		m.Routes = data.([]Route)
+		if m.Routes == nil {
+			m.Routes = make([]Route, 0)
+		}
 		m.SetHash()
+		//nothing changed, keep the current memento
+		if l := len(c.Mementos); l > 0 && c.Mementos[l-1].Hash == m.Hash {
+			c.lock.Unlock()
+			return
+		}
 	case Route:
 		m.Routes = append(m.Routes, data.(Route))
 		klog.Infof("route added %v", data)
@@ -46,10 +54,47 @@ func (c *Cache) update(data interface{}) {
 	c.lock.Unlock()
 }
 
+// latestHash is the hash of the latest memento, empty if there is none.
+func (c *Cache) latestHash() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if l := len(c.Mementos); l > 0 {
+		return c.Mementos[l-1].Hash
+	}
+	return ""
+}
+
+// markGood records config as rolled out healthy for the latest memento with hash.
+func (c *Cache) markGood(hash string, config string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := len(c.Mementos) - 1; i >= 0; i-- {
+		if c.Mementos[i].Hash == hash {
+			c.Mementos[i].Config = config
+			return
+		}
+	}
+}
+
+// lastGood is the latest memento that rolled out healthy, nil if there is none.
+func (c *Cache) lastGood() *Memento {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := len(c.Mementos) - 1; i >= 0; i-- {
+		if len(c.Mementos[i].Config) > 0 {
+			m := c.Mementos[i]
+			return &m
+		}
+	}
+	return nil
+}
+
 type Memento struct {
 	Routes      []Route
 	Hash        string
 	DateCreated time.Time
+	//Config is the j8a config rendered from the routes once it rolled out healthy, empty before.
+	Config string
 }
 
 func NewMemento() *Memento {
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+)
+
+// Config is the controller config file. It configures either a single fleet under j8a, or several fleets, each with
+// a unique name.
+//
+//	j8a:
+//	  version: v1.1.0
+//	  image: simonmittag/j8a
+//	  imagePullSecrets: [registry]
+//	  upgrade:
+//	    canary: true
+//	  adopt: false
+//	  namespace: j8a
+//	  ingressClass: ingress-j8a
+//	  service: loadbalancer-j8a
+//	  loadBalancer:
+//	    type: LoadBalancer
+//	    profile: aws
+//	  deployment:
+//	    name: deployment-j8a
+//	    replicas: 3
+//	    minAvailable: 1
+//	  pod:
+//	    name: j8a
+//	    label:
+//	      app: j8a
+//
+//	fleets:
+//	  - name: public
+//	    ingressClass: j8a-public
+//	  - name: internal
+//	    ingressClass: j8a-internal
+//	    serviceAnnotations:
+//	      service.beta.kubernetes.io/aws-load-balancer-internal: "true"
+type Config struct {
+	J8a    *J8a   `json:"j8a,omitempty"`
+	Fleets []*J8a `json:"fleets,omitempty"`
+}
+
+const envPrefix = "INGRESS_J8A_"
+
+// Configure overrides the j8a defaults in order of precedence, lowest first: config file, environment variables,
+// then flags. Only values that are set in a source override, a map replaces the previous map entirely. With several
+// fleets, environment and flags may only override version, image, digest, replicas, adopt and the service type and
+// profile, which then apply to all fleets.
+func (s *Server) Configure(path string, lookupEnv func(string) (string, bool), flags *J8a) error {
+	if len(path) > 0 {
+		c, e := LoadConfigFile(path)
+		if e != nil {
+			return e
+		}
+		if e = s.configureFleets(c); e != nil {
+			return e
+		}
+	}
+
+	env, e := LoadConfigEnv(lookupEnv)
+	if e != nil {
+		return e
+	}
+	if flags == nil {
+		flags = &J8a{}
+	}
+	for _, o := range []*J8a{env, flags} {
+		if len(s.Fleets) > 1 && !o.sharedOnly() {
+			return fmt.Errorf("with several fleets only version, image, digest, replicas, adopt and service type and profile can be set from env or flags, use the config file")
+		}
+		for _, f := range s.Fleets {
+			f.merge(o)
+		}
+	}
+	for _, f := range s.Fleets {
+		if e := f.LoadBalancer.validate(); e != nil {
+			return fmt.Errorf("invalid loadBalancer for fleet '%v', cause: %v", f, e)
+		}
+		if e := f.validateImage(); e != nil {
+			return fmt.Errorf("invalid image for fleet '%v', cause: %v", f, e)
+		}
+		if e := f.Deployment.validate(); e != nil {
+			return fmt.Errorf("invalid deployment for fleet '%v', cause: %v", f, e)
+		}
+	}
+	return nil
+}
+
+func (s *Server) configureFleets(c *Config) error {
+	if c.J8a != nil && len(c.Fleets) > 0 {
+		return fmt.Errorf("config file must contain either j8a or fleets, not both")
+	}
+	if c.J8a != nil {
+		f := NewJ8a(c.J8a.Name)
+		f.merge(c.J8a)
+		s.Fleets = []*J8a{f}
+	}
+	if len(c.Fleets) > 0 {
+		fleets := make([]*J8a, 0)
+		names := make(map[string]bool)
+		classes := make(map[string]bool)
+		for _, cf := range c.Fleets {
+			if len(cf.Name) == 0 || names[cf.Name] {
+				return fmt.Errorf("each fleet needs a unique name, got '%v'", cf.Name)
+			}
+			f := NewJ8a(cf.Name)
+			f.merge(cf)
+			if classes[f.IngressClass] {
+				return fmt.Errorf("fleet '%v' uses ingressClass '%v' of another fleet", f.Name, f.IngressClass)
+			}
+			for _, o := range fleets {
+				if e := f.collides(o); e != nil {
+					return e
+				}
+			}
+			names[f.Name] = true
+			classes[f.IngressClass] = true
+			fleets = append(fleets, f)
+		}
+		s.Fleets = fleets
+	}
+
+	defaults := 0
+	for _, f := range s.Fleets {
+		if f.DefaultClass != nil && *f.DefaultClass {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("only one fleet can be the default ingressClass, got %v", defaults)
+	}
+	return nil
+}
+
+// collides rejects fleets in one namespace that would fight over the same objects. The deployment name also names the
+// canary, disruption budget, autoscaler, networkPolicy and config objects. Pod labels overlap unless they disagree on
+// a key, overlapping fleets would select each other's pods.
+func (j *J8a) collides(o *J8a) error {
+	if j.Namespace != o.Namespace {
+		return nil
+	}
+	if j.Deployment.Name == o.Deployment.Name {
+		return fmt.Errorf("fleet '%v' uses deployment '%v/%v' of fleet '%v'", j, j.Namespace, j.Deployment.Name, o)
+	}
+	if j.Service == o.Service {
+		return fmt.Errorf("fleet '%v' uses service '%v/%v' of fleet '%v'", j, j.Namespace, j.Service, o)
+	}
+	for k, v := range j.Pod.Label {
+		if ov, ok := o.Pod.Label[k]; ok && ov != v {
+			return nil
+		}
+	}
+	return fmt.Errorf("fleet '%v' pod labels %v overlap with pod labels %v of fleet '%v'", j, j.Pod.Label, o.Pod.Label, o)
+}
+
+func LoadConfigFile(path string) (*Config, error) {
+	b, e := os.ReadFile(path)
+	if e != nil {
+		return nil, fmt.Errorf("unable to read config file '%v', cause: %v", path, e)
+	}
+	c := &Config{}
+	if e = yaml.UnmarshalStrict(b, c); e != nil {
+		return nil, fmt.Errorf("unable to parse config file '%v', cause: %v", path, e)
+	}
+	return c, nil
+}
+
+// LoadConfigEnv reads INGRESS_J8A_* variables, i.e. INGRESS_J8A_DEPLOYMENT_REPLICAS=5 or
+// INGRESS_J8A_POD_LABEL=app=j8a,tier=edge
+func LoadConfigEnv(lookupEnv func(string) (string, bool)) (*J8a, error) {
+	j := &J8a{}
+	strs := map[string]*string{
+		"VERSION":         &j.Version,
+		"IMAGE":           &j.Image,
+		"DIGEST":          &j.Digest,
+		"NAMESPACE":       &j.Namespace,
+		"INGRESS_CLASS":   &j.IngressClass,
+		"SERVICE":         &j.Service,
+		"DEPLOYMENT_NAME": &j.Deployment.Name,
+		"POD_NAME":        &j.Pod.Name,
+		"SERVICE_TYPE":    &j.LoadBalancer.Type,
+		"SERVICE_PROFILE": &j.LoadBalancer.Profile,
+	}
+	for k, v := range strs {
+		if ev, ok := lookupEnv(envPrefix + k); ok {
+			*v = ev
+		}
+	}
+
+	if ev, ok := lookupEnv(envPrefix + "DEPLOYMENT_REPLICAS"); ok {
+		r, e := strconv.Atoi(ev)
+		if e != nil {
+			return nil, fmt.Errorf("invalid %vDEPLOYMENT_REPLICAS '%v', cause: %v", envPrefix, ev, e)
+		}
+		j.Deployment.Replicas = r
+	}
+	if ev, ok := lookupEnv(envPrefix + "POD_LABEL"); ok {
+		l, e := ParseLabels(ev)
+		if e != nil {
+			return nil, fmt.Errorf("invalid %vPOD_LABEL, cause: %v", envPrefix, e)
+		}
+		j.Pod.Label = l
+	}
+	return j, nil
+}
+
+// ParseLabels reads a comma separated list of key=value pairs.
+func ParseLabels(s string) (map[string]string, error) {
+	l := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || len(k) == 0 {
+			return nil, fmt.Errorf("label '%v' is not key=value", kv)
+		}
+		l[k] = v
+	}
+	return l, nil
+}
+
+// sharedOnly is true if j sets nothing but version, image, digest, replicas, adopt and the service type and profile,
+// which can be shared across fleets. Service type and profile depend on the cluster, not the fleet.
+func (j *J8a) sharedOnly() bool {
+	shared := J8a{
+		Version:      j.Version,
+		Image:        j.Image,
+		Digest:       j.Digest,
+		Adopt:        j.Adopt,
+		Deployment:   Deployment{Replicas: j.Deployment.Replicas},
+		LoadBalancer: LoadBalancer{Type: j.LoadBalancer.Type, Profile: j.LoadBalancer.Profile},
+	}
+	return reflect.DeepEqual(&shared, j)
+}
+
+func (j *J8a) merge(o *J8a) {
+	mergeString(&j.Version, o.Version)
+	mergeString(&j.Image, o.Image)
+	mergeString(&j.Digest, o.Digest)
+	if o.ImagePullSecrets != nil {
+		j.ImagePullSecrets = o.ImagePullSecrets
+	}
+	if o.Upgrade != nil {
+		j.Upgrade = o.Upgrade
+	}
+	if o.Adopt {
+		j.Adopt = true
+	}
+	mergeString(&j.Namespace, o.Namespace)
+	mergeString(&j.IngressClass, o.IngressClass)
+	mergeString(&j.Service, o.Service)
+	mergeString(&j.Deployment.Name, o.Deployment.Name)
+	if o.Deployment.Replicas > 0 {
+		j.Deployment.Replicas = o.Deployment.Replicas
+	}
+	if o.Deployment.MinAvailable != nil {
+		j.Deployment.MinAvailable = o.Deployment.MinAvailable
+	}
+	if o.Deployment.Autoscaling != nil {
+		j.Deployment.Autoscaling = o.Deployment.Autoscaling
+	}
+	if o.Deployment.ProgressDeadlineSeconds != nil {
+		j.Deployment.ProgressDeadlineSeconds = o.Deployment.ProgressDeadlineSeconds
+	}
+	j.Pod.merge(o.Pod)
+	if o.ServiceAnnotations != nil {
+		j.ServiceAnnotations = o.ServiceAnnotations
+	}
+	if o.DefaultClass != nil {
+		j.DefaultClass = o.DefaultClass
+	}
+	if o.Parameters != nil {
+		j.Parameters = o.Parameters
+	}
+	if o.ACME != nil {
+		j.ACME = o.ACME
+	}
+	j.LoadBalancer.merge(o.LoadBalancer)
+}
+
+func mergeString(dst *string, src string) {
+	if len(src) > 0 {
+		*dst = src
+	}
+}
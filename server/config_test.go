@@ -0,0 +1,183 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func envOf(m map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := m[k]
+		return v, ok
+	}
+}
+
+func TestConfigurePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`
+j8a:
+  version: v1.2.0
+  image: registry.example.com/j8a
+  namespace: j8a-staging
+  deployment:
+    replicas: 5
+  pod:
+    label:
+      app: j8a-staging
+`), 0644)
+
+	s := NewServer()
+	e := s.Configure(path,
+		envOf(map[string]string{
+			"INGRESS_J8A_NAMESPACE":           "j8a-env",
+			"INGRESS_J8A_DEPLOYMENT_REPLICAS": "7",
+		}),
+		&J8a{Deployment: Deployment{Replicas: 9}})
+	if e != nil {
+		t.Fatalf("should configure, got %v", e)
+	}
+
+	if s.Fleets[0].Version != "v1.2.0" || s.Fleets[0].Image != "registry.example.com/j8a" {
+		t.Errorf("config file should override defaults, got %v %v", s.Fleets[0].Version, s.Fleets[0].Image)
+	}
+	if s.Fleets[0].Namespace != "j8a-env" {
+		t.Errorf("env should override config file, got %v", s.Fleets[0].Namespace)
+	}
+	if s.Fleets[0].Deployment.Replicas != 9 {
+		t.Errorf("flags should override env, got %v", s.Fleets[0].Deployment.Replicas)
+	}
+	if s.Fleets[0].Deployment.Name != "deployment-j8a" || s.Fleets[0].IngressClass != "ingress-j8a" {
+		t.Errorf("unset values should keep defaults, got %v %v", s.Fleets[0].Deployment.Name, s.Fleets[0].IngressClass)
+	}
+	if len(s.Fleets[0].Pod.Label) != 1 || s.Fleets[0].Pod.Label["app"] != "j8a-staging" {
+		t.Errorf("labels should be replaced, got %v", s.Fleets[0].Pod.Label)
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	s := NewServer()
+	if e := s.Configure(filepath.Join(t.TempDir(), "missing.yml"), envOf(nil), nil); e == nil {
+		t.Errorf("should fail for missing config file")
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte("j8a:\n  unknown: true\n"), 0644)
+	if e := s.Configure(path, envOf(nil), nil); e == nil {
+		t.Errorf("should fail for unknown config key")
+	}
+
+	if e := s.Configure("", envOf(map[string]string{"INGRESS_J8A_DEPLOYMENT_REPLICAS": "many"}), nil); e == nil {
+		t.Errorf("should fail for invalid replicas")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	l, e := ParseLabels("app=j8a, tier=edge")
+	if e != nil || len(l) != 2 || l["tier"] != "edge" {
+		t.Errorf("should parse labels, got %v %v", l, e)
+	}
+	if _, e := ParseLabels("app"); e == nil {
+		t.Errorf("should not parse label without value")
+	}
+}
+
+func TestConfigureFleets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`
+fleets:
+  - name: public
+  - name: internal
+    ingressClass: j8a-internal
+    serviceAnnotations:
+      service.beta.kubernetes.io/aws-load-balancer-internal: "true"
+`), 0644)
+
+	s := NewServer()
+	if e := s.Configure(path, envOf(map[string]string{"INGRESS_J8A_VERSION": "v1.2.0"}), nil); e != nil {
+		t.Fatalf("should configure fleets, got %v", e)
+	}
+	if len(s.Fleets) != 2 {
+		t.Fatalf("want 2 fleets, got %v", len(s.Fleets))
+	}
+	pub, internal := s.Fleets[0], s.Fleets[1]
+	if pub.Deployment.Name != "deployment-j8a-public" || pub.Service != "loadbalancer-j8a-public" || pub.IngressClass != "ingress-j8a-public" {
+		t.Errorf("named fleet should derive its names, got %v %v %v", pub.Deployment.Name, pub.Service, pub.IngressClass)
+	}
+	if pub.Pod.Label["fleet"] != "public" || internal.Pod.Label["fleet"] != "internal" {
+		t.Errorf("fleets should select their own pods, got %v %v", pub.Pod.Label, internal.Pod.Label)
+	}
+	if internal.IngressClass != "j8a-internal" || internal.ServiceAnnotations["service.beta.kubernetes.io/aws-load-balancer-internal"] != "true" {
+		t.Errorf("fleet should use configured class and annotations")
+	}
+	if pub.Version != "v1.2.0" || internal.Version != "v1.2.0" {
+		t.Errorf("env version should apply to all fleets")
+	}
+	if pub.Cache == internal.Cache {
+		t.Errorf("fleets should not share a cache")
+	}
+
+	if e := s.Configure("", envOf(map[string]string{"INGRESS_J8A_NAMESPACE": "j8a"}), nil); e == nil {
+		t.Errorf("should not override names of several fleets from env")
+	}
+	digest := "sha256:" + strings.Repeat("a", 64)
+	if e := s.Configure("", envOf(map[string]string{"INGRESS_J8A_DIGEST": digest}), &J8a{Adopt: true}); e != nil {
+		t.Errorf("should share digest and adopt across fleets, got %v", e)
+	}
+	if pub.Digest != digest || !internal.Adopt {
+		t.Errorf("shared values should apply to all fleets")
+	}
+}
+
+func TestConfigureFleetsErrors(t *testing.T) {
+	for _, c := range []string{
+		"fleets:\n  - name: a\n  - name: a\n",
+		"fleets:\n  - ingressClass: x\n",
+		"fleets:\n  - name: a\n    ingressClass: x\n  - name: b\n    ingressClass: x\n",
+		"j8a:\n  namespace: x\nfleets:\n  - name: a\n",
+		"fleets:\n  - name: a\n    deployment:\n      name: j8a\n  - name: b\n    deployment:\n      name: j8a\n",
+		"fleets:\n  - name: a\n    service: lb\n  - name: b\n    service: lb\n",
+		"fleets:\n  - name: a\n    pod:\n      label: {app: j8a}\n  - name: b\n",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yml")
+		os.WriteFile(path, []byte(c), 0644)
+		if e := NewServer().Configure(path, envOf(nil), nil); e == nil {
+			t.Errorf("should reject config\n%v", c)
+		}
+	}
+}
+
+func TestFleetsInOtherNamespacesDoNotCollide(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte("fleets:\n  - name: a\n    service: lb\n  - name: b\n    namespace: other\n    service: lb\n"), 0644)
+	if e := NewServer().Configure(path, envOf(nil), nil); e != nil {
+		t.Errorf("fleets in different namespaces may share names, got %v", e)
+	}
+}
+
+func TestConfigureRejectsSeveralDefaultClasses(t *testing.T) {
+	f, _ := os.CreateTemp(t.TempDir(), "config*.yml")
+	f.WriteString("fleets:\n  - name: a\n    defaultClass: true\n  - name: b\n    defaultClass: true\n")
+	f.Close()
+
+	s := NewServer()
+	if e := s.Configure(f.Name(), envOf(nil), nil); e == nil {
+		t.Errorf("should reject more than one default ingressClass")
+	}
+}
+
+func TestConfigureLoadBalancer(t *testing.T) {
+	s := NewServer()
+	if e := s.Configure("", envOf(map[string]string{envPrefix + "SERVICE_TYPE": "NodePort", envPrefix + "SERVICE_PROFILE": "none"}), nil); e != nil {
+		t.Fatalf("should configure service type from env, got %v", e)
+	}
+	if s.Fleets[0].LoadBalancer.Type != "NodePort" || s.Fleets[0].LoadBalancer.Profile != "none" {
+		t.Errorf("unexpected loadBalancer %+v", s.Fleets[0].LoadBalancer)
+	}
+
+	s = NewServer()
+	if e := s.Configure("", envOf(map[string]string{envPrefix + "SERVICE_TYPE": "Headless"}), nil); e == nil {
+		t.Errorf("should reject unsupported service type")
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+const (
+	configFileKey  = "j8acfg.yml"
+	configFileDir  = "/etc/j8a"
+	configVolume   = "config"
+	redactedKeyPEM = "<redacted, see secret>"
+)
+
+// redactConfig removes every private key from the j8a config, so the ConfigMap can publish the rest for inspection
+// with kubectl. The config is parsed, so keys are found by their place, whatever their format: the tls key of the
+// downstream listener and its sni hosts, and the key of every jwt, which is the shared secret for HS256.
+func redactConfig(config string) (string, error) {
+	m := make(map[string]interface{})
+	if e := yaml.Unmarshal([]byte(config), &m); e != nil {
+		return "", fmt.Errorf("unable to parse j8a config for redaction, cause: %v", e)
+	}
+	if tls, ok := lookup(m, "connection", "downstream", "tls").(map[string]interface{}); ok {
+		redactKey(tls)
+		if sni, ok := tls["sni"].([]interface{}); ok {
+			for _, h := range sni {
+				redactKey(h)
+			}
+		}
+	}
+	if jwt, ok := m["jwt"].(map[string]interface{}); ok {
+		for _, j := range jwt {
+			redactKey(j)
+		}
+	}
+	b, e := yaml.Marshal(m)
+	if e != nil {
+		return "", e
+	}
+	return string(b), nil
+}
+
+func lookup(m map[string]interface{}, path ...string) interface{} {
+	var v interface{} = m
+	for _, p := range path {
+		mm, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = mm[p]
+	}
+	return v
+}
+
+func redactKey(v interface{}) {
+	if m, ok := v.(map[string]interface{}); ok {
+		if _, ok := m["key"]; ok {
+			m["key"] = redactedKeyPEM
+		}
+	}
+}
+
+// configObjectName names the ConfigMap published next to the config secrets.
+func (j *J8a) configObjectName() string {
+	return j.Deployment.Name + "-config"
+}
+
+// configSecretName is content addressed. Each config gets its own immutable Secret, so pods of a rollout, and a
+// rollback to the previous config, mount exactly the config their template was rendered with.
+func (j *J8a) configSecretName(config string) string {
+	return j.configObjectName() + "-" + hashOf(config)[:10]
+}
+
+// withConfigFile starts j8a with the config file mounted from its Secret instead of the J8ACFG_YML env var. The
+// secret name changes with the content, so the pods roll as before.
+func (j *J8a) withConfigFile(d *appsv1.Deployment, config string) {
+	spec := &d.Spec.Template.Spec
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		if c.Name != j.Pod.Name {
+			continue
+		}
+		env := make([]apiv1.EnvVar, 0)
+		for _, ev := range c.Env {
+			if ev.Name != "J8ACFG_YML" {
+				env = append(env, ev)
+			}
+		}
+		c.Env = env
+		c.Args = append(c.Args, "-c", configFileDir+"/"+configFileKey)
+		c.VolumeMounts = append(c.VolumeMounts, apiv1.VolumeMount{Name: configVolume, MountPath: configFileDir, ReadOnly: true})
+	}
+	spec.Volumes = append(spec.Volumes, apiv1.Volume{
+		Name: configVolume,
+		VolumeSource: apiv1.VolumeSource{Secret: &apiv1.SecretVolumeSource{
+			SecretName: j.configSecretName(config),
+		}},
+	})
+}
+
+// reconcileJ8aConfigFile publishes config to the immutable Secret mounted by j8a and its redacted copy to the
+// ConfigMap.
+func (s *Server) reconcileJ8aConfigFile(ctx context.Context, f *J8a, config string) error {
+	redacted, e := redactConfig(config)
+	if e != nil {
+		return e
+	}
+	name := f.configSecretName(config)
+	secretsClient := s.Kube.Client.CoreV1().Secrets(f.Namespace)
+	e = s.reconcile(ctx, f, managed{
+		kind: "secret",
+		name: name,
+		want: &apiv1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: f.Namespace},
+			Type:       apiv1.SecretTypeOpaque,
+			Immutable:  boolPtr(true),
+			Data:       map[string][]byte{configFileKey: []byte(config)},
+		},
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return secretsClient.Get(ctx, name, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := secretsClient.Patch(ctx, name, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+	if e != nil {
+		return e
+	}
+
+	cm := f.configObjectName()
+	configMapsClient := s.Kube.Client.CoreV1().ConfigMaps(f.Namespace)
+	return s.reconcile(ctx, f, managed{
+		kind: "configMap",
+		name: cm,
+		want: &apiv1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Name: cm, Namespace: f.Namespace},
+			Data:       map[string]string{configFileKey: redacted},
+		},
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return configMapsClient.Get(ctx, cm, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := configMapsClient.Patch(ctx, cm, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+}
+
+// cleanupJ8aConfigFiles deletes the config secrets of the fleet other than the one of config. It runs once a rollout
+// completed, so no pod mounts them any more. The mutable secret of previous releases goes as well.
+func (s *Server) cleanupJ8aConfigFiles(ctx context.Context, f *J8a, config string) {
+	secretsClient := s.Kube.Client.CoreV1().Secrets(f.Namespace)
+	sl, e := secretsClient.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{ManagedByLabel: managedBy, InstanceLabel: f.String()}).String(),
+	})
+	if e != nil {
+		s.Log.Errorf("unable to list config secrets of deployment '%v', cause: %v", f.Deployment.Name, e)
+		return
+	}
+	keep := f.configSecretName(config)
+	for _, sec := range sl.Items {
+		if sec.Name == keep || (sec.Name != f.configObjectName() && !strings.HasPrefix(sec.Name, f.configObjectName()+"-")) {
+			continue
+		}
+		if e := secretsClient.Delete(ctx, sec.Name, metav1.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
+			s.Log.Errorf("unable to delete secret '%v', cause: %v", sec.Name, e)
+		} else {
+			s.Log.Infof("deleted config secret '%v'", sec.Name)
+		}
+	}
+}
+
+// liveConfigFile is the config in the Secret mounted by the live deployment, empty if there is none.
+func (s *Server) liveConfigFile(ctx context.Context, f *J8a, live *appsv1.Deployment) string {
+	for _, v := range live.Spec.Template.Spec.Volumes {
+		if v.Name != configVolume || v.Secret == nil {
+			continue
+		}
+		sec, e := s.Kube.Client.CoreV1().Secrets(f.Namespace).Get(ctx, v.Secret.SecretName, metav1.GetOptions{})
+		if e != nil {
+			return ""
+		}
+		return string(sec.Data[configFileKey])
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package server
+
+import "fmt"
+
+// Phase names a step of the bootstrap sequence.
+type Phase string
+
+const (
+	PhaseAuth         Phase = "auth"
+	PhaseVersion      Phase = "version"
+	PhasePermissions  Phase = "permissions"
+	PhaseNamespace    Phase = "namespace"
+	PhaseIngressClass Phase = "ingressclass"
+	PhaseDeployment   Phase = "deployment"
+	PhaseService      Phase = "service"
+	PhaseScaling      Phase = "scaling"
+	PhaseConfig       Phase = "config"
+)
+
+// BootstrapError wraps the cause of a failed bootstrap together with the phase it failed in. Use errors.As to
+// inspect the phase.
+type BootstrapError struct {
+	Phase Phase
+	Fleet string
+	Err   error
+}
+
+func (e *BootstrapError) Error() string {
+	if len(e.Fleet) > 0 {
+		return fmt.Sprintf("bootstrap failed in phase %v for fleet %v, cause: %v", e.Phase, e.Fleet, e.Err)
+	}
+	return fmt.Sprintf("bootstrap failed in phase %v, cause: %v", e.Phase, e.Err)
+}
+
+func (e *BootstrapError) Unwrap() error {
+	return e.Err
+}
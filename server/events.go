@@ -0,0 +1,39 @@
+package server
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Events records kubernetes events against the objects the controller processes, i.e. rejected ingress resources.
+type Events struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+}
+
+func (s *Server) startEvents() {
+	if !s.Features.Events {
+		return
+	}
+	s.Events.broadcaster = record.NewBroadcaster()
+	s.Events.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: s.Kube.Client.CoreV1().Events("")})
+	s.Events.recorder = s.Events.broadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: "ingress-j8a"})
+}
+
+// stopEvents flushes queued events to the apiserver and stops recording.
+func (s *Server) stopEvents() {
+	if s.Events.broadcaster != nil {
+		s.Events.broadcaster.Shutdown()
+		s.Events.broadcaster = nil
+		s.Events.recorder = nil
+	}
+}
+
+func (s *Server) event(o runtime.Object, eventType string, reason string, msgf string, vals ...interface{}) {
+	if s.Events.recorder != nil {
+		s.Events.recorder.Eventf(o, eventType, reason, msgf, vals...)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	netlisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"time"
+)
+
+// resyncPeriod redelivers every cached object, so time based work such as acme renewal and certificate expiry runs
+// without a change in the cluster.
+const resyncPeriod = time.Minute * 10
+
+// listers read the objects the fleets are configured from out of the shared informer cache.
+type listers struct {
+	ingresses      netlisters.IngressLister
+	ingressClasses netlisters.IngressClassLister
+	services       corelisters.ServiceLister
+	secrets        corelisters.SecretLister
+	configMaps     corelisters.ConfigMapLister
+}
+
+// startInformers watches ingress, ingressClasses, services, secrets and configMaps cluster wide and signals changed
+// on every add, update or delete. Once the caches are synced reads go to the cache instead of the apiserver.
+func (s *Server) startInformers(ctx context.Context, changed chan<- struct{}) error {
+	f := informers.NewSharedInformerFactory(s.Kube.Client, resyncPeriod)
+	ingresses := f.Networking().V1().Ingresses()
+	ingressClasses := f.Networking().V1().IngressClasses()
+	services := f.Core().V1().Services()
+	secrets := f.Core().V1().Secrets()
+	configMaps := f.Core().V1().ConfigMaps()
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify(changed) },
+		UpdateFunc: func(interface{}, interface{}) { notify(changed) },
+		DeleteFunc: func(interface{}) { notify(changed) },
+	}
+	for _, i := range []cache.SharedIndexInformer{
+		ingresses.Informer(),
+		ingressClasses.Informer(),
+		services.Informer(),
+		secrets.Informer(),
+		configMaps.Informer(),
+	} {
+		if _, e := i.AddEventHandler(handler); e != nil {
+			return fmt.Errorf("unable to watch cluster config, cause: %v", e)
+		}
+	}
+
+	f.Start(ctx.Done())
+	for t, ok := range f.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return fmt.Errorf("unable to sync informer cache of %v", t)
+		}
+	}
+	s.listers = &listers{
+		ingresses:      ingresses.Lister(),
+		ingressClasses: ingressClasses.Lister(),
+		services:       services.Lister(),
+		secrets:        secrets.Lister(),
+		configMaps:     configMaps.Lister(),
+	}
+	return nil
+}
+
+// notify signals changed without blocking, signals that arrive during a reconcile collapse into one.
+func notify(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+// Objects are read from the informer cache once the daemon synced it. Bootstrap and status run before or without
+// the daemon and read from the apiserver. Cached objects are shared, callers must not modify them.
+
+func (s *Server) getSecret(ctx context.Context, namespace string, name string) (*apiv1.Secret, error) {
+	if s.listers != nil {
+		return s.listers.secrets.Secrets(namespace).Get(name)
+	}
+	return s.Kube.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (s *Server) getService(ctx context.Context, namespace string, name string) (*apiv1.Service, error) {
+	if s.listers != nil {
+		return s.listers.services.Services(namespace).Get(name)
+	}
+	return s.Kube.Client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (s *Server) getConfigMap(ctx context.Context, namespace string, name string) (*apiv1.ConfigMap, error) {
+	if s.listers != nil {
+		return s.listers.configMaps.ConfigMaps(namespace).Get(name)
+	}
+	return s.Kube.Client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (s *Server) getIngressClass(ctx context.Context, name string) (*netv1.IngressClass, error) {
+	if s.listers != nil {
+		return s.listers.ingressClasses.Get(name)
+	}
+	return s.Kube.Client.NetworkingV1().IngressClasses().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (s *Server) fetchIngressClasses(ctx context.Context) ([]netv1.IngressClass, error) {
+	if s.listers != nil {
+		l, e := s.listers.ingressClasses.List(labels.Everything())
+		if e != nil {
+			return nil, e
+		}
+		ics := make([]netv1.IngressClass, 0, len(l))
+		for _, ic := range l {
+			ics = append(ics, *ic)
+		}
+		sort.Slice(ics, func(i, j int) bool { return ics[i].Name < ics[j].Name })
+		return ics, nil
+	}
+	icl, e := s.Kube.Client.NetworkingV1().IngressClasses().List(ctx, metav1.ListOptions{})
+	if e != nil {
+		return nil, e
+	}
+	return icl.Items, nil
+}
+
+// fetchIngress lists all ingress in the order of the apiserver, by namespace and name, so the same ingress always
+// render the same config.
+func (s *Server) fetchIngress(ctx context.Context) (*netv1.IngressList, error) {
+	if s.listers == nil {
+		return s.Kube.Client.NetworkingV1().Ingresses("").List(ctx, metav1.ListOptions{})
+	}
+	l, e := s.listers.ingresses.List(labels.Everything())
+	if e != nil {
+		return nil, e
+	}
+	il := &netv1.IngressList{Items: make([]netv1.Ingress, 0, len(l))}
+	for _, igrs := range l {
+		il.Items = append(il.Items, *igrs)
+	}
+	sort.Slice(il.Items, func(i, j int) bool {
+		a, b := il.Items[i], il.Items[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return il, nil
+}
+
+// logObjects logs the size of the informer cache once it is synced.
+func (s *Server) logObjects() {
+	if s.listers == nil {
+		return
+	}
+	if cm, e := s.listers.configMaps.List(labels.Everything()); e == nil {
+		s.Log.Infof("detected %d config maps", len(cm))
+	}
+	if sv, e := s.listers.services.List(labels.Everything()); e == nil {
+		s.Log.Infof("detected %d services", len(sv))
+	}
+	if sl, e := s.listers.secrets.List(labels.Everything()); e == nil {
+		s.Log.Infof("detected %d secrets", len(sl))
+	}
+	if il, e := s.listers.ingresses.List(labels.Everything()); e == nil {
+		s.Log.Infof("detected %d ingress", len(il))
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestInformersServeFromCache(t *testing.T) {
+	s := NewServer()
+	c := newFakeClientset()
+	s.Kube.Client = c
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	bg := context.TODO()
+	c.CoreV1().Services("default").Create(bg, &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "s1", Namespace: "default"},
+		Spec:       apiv1.ServiceSpec{Ports: []apiv1.ServicePort{{Name: "http", Port: 8080}}},
+	}, metav1.CreateOptions{})
+	c.NetworkingV1().Ingresses("default").Create(bg, ingressFor("b", "x", netv1.ServiceBackendPort{Number: 80}), metav1.CreateOptions{})
+	c.NetworkingV1().Ingresses("default").Create(bg, ingressFor("a", "x", netv1.ServiceBackendPort{Number: 80}), metav1.CreateOptions{})
+
+	changed := make(chan struct{}, 1)
+	if e := s.startInformers(ctx, changed); e != nil {
+		t.Fatalf("should sync informers, got %v", e)
+	}
+	s.logObjects()
+	c.ClearActions()
+
+	port, e := s.fetchBackendServicePort(bg, "default", netv1.IngressBackend{
+		Service: &netv1.IngressServiceBackend{Name: "s1", Port: netv1.ServiceBackendPort{Name: "http"}},
+	})
+	if e != nil || port != "8080" {
+		t.Errorf("should resolve named port from cache, got %v %v", port, e)
+	}
+	il, e := s.fetchIngress(bg)
+	if e != nil || len(il.Items) != 2 || il.Items[0].Name != "a" {
+		t.Errorf("should list ingress from cache by name, got %v %v", il, e)
+	}
+	if a := c.Actions(); len(a) > 0 {
+		t.Errorf("reads should not reach the apiserver, got %v", a)
+	}
+
+	//the initial list signals too
+	<-changed
+	c.CoreV1().Secrets("default").Create(bg, &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: "default"},
+	}, metav1.CreateOptions{})
+	select {
+	case <-changed:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("should signal a changed secret")
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for _, e := s.getSecret(bg, "default", "tls"); e != nil; _, e = s.getSecret(bg, "default", "tls") {
+		if time.Now().After(deadline) {
+			t.Fatalf("should cache the secret, got %v", e)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	s := NewServer()
+	f := s.Fleets[0]
+	f.config = "config"
+	f.image = f.imageRef()
+	if s.inProgress() {
+		t.Errorf("fleet on its image should not be in progress")
+	}
+	f.Version = "v9.9.9"
+	if !s.inProgress() {
+		t.Errorf("pending upgrade should be in progress")
+	}
+	f.rejectedImages[f.upgradeKey(f.imageRef())] = true
+	if s.inProgress() {
+		t.Errorf("rejected upgrade should not be in progress")
+	}
+}
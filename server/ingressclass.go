@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	netv1 "k8s.io/api/networking/v1"
+)
+
+const (
+	defaultClassAnnotation = "ingressclass.kubernetes.io/is-default-class"
+	// deprecated before ingressClassName, still honoured by kube for ingress without class
+	legacyClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+func isDefaultClass(ic netv1.IngressClass) bool {
+	return ic.Annotations[defaultClassAnnotation] == "true"
+}
+
+// foreignDefaultClasses lists default ingressClasses that do not belong to any of our fleets.
+func (s *Server) foreignDefaultClasses(ctx context.Context) ([]string, error) {
+	ics, e := s.fetchIngressClasses(ctx)
+	if e != nil {
+		return nil, fmt.Errorf("unable to list ingressClasses, cause: %v", e)
+	}
+	foreign := make([]string, 0)
+	for _, ic := range ics {
+		if isDefaultClass(ic) && s.fleetForClass(ic.Name) == nil {
+			foreign = append(foreign, ic.Name)
+		}
+	}
+	return foreign, nil
+}
+
+// detectDefaultClass decides which fleet serves ingress without ingressClassName. A fleet only does so if its own
+// ingressClass is marked default in the cluster and no other ingressClass is, otherwise kube itself treats the
+// default as ambiguous.
+func (s *Server) detectDefaultClass(ctx context.Context) error {
+	ics, e := s.fetchIngressClasses(ctx)
+	if e != nil {
+		return fmt.Errorf("unable to list ingressClasses, cause: %v", e)
+	}
+	defaults := make([]string, 0)
+	for _, ic := range ics {
+		if isDefaultClass(ic) {
+			defaults = append(defaults, ic.Name)
+		}
+	}
+	for _, f := range s.Fleets {
+		serves := len(defaults) == 1 && defaults[0] == f.IngressClass
+		if serves != f.servesDefault {
+			if serves {
+				s.Log.Infof("ingressClass '%v' is the cluster default, routing ingress without ingressClassName", f.IngressClass)
+			} else if f.servesDefault {
+				s.Log.Infof("ingressClass '%v' no longer the only cluster default %v, ignoring ingress without ingressClassName", f.IngressClass, defaults)
+			}
+		}
+		f.servesDefault = serves
+	}
+	return nil
+}
+
+func (s *Server) fleetForClass(name string) *J8a {
+	for _, f := range s.Fleets {
+		if f.IngressClass == name {
+			return f
+		}
+	}
+	return nil
+}
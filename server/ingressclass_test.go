@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func ingressClass(name string, isDefault bool) *netv1.IngressClass {
+	ic := &netv1.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if isDefault {
+		ic.Annotations = map[string]string{defaultClassAnnotation: "true"}
+	}
+	return ic
+}
+
+func TestDetectDefaultClass(t *testing.T) {
+	ingressJ8a := NewJ8a("").IngressClass
+	tests := []struct {
+		name    string
+		classes []*netv1.IngressClass
+		want    bool
+	}{
+		{"sole default", []*netv1.IngressClass{ingressClass(ingressJ8a, true), ingressClass("nginx", false)}, true},
+		{"second default", []*netv1.IngressClass{ingressClass(ingressJ8a, true), ingressClass("nginx", true)}, false},
+		{"not default", []*netv1.IngressClass{ingressClass(ingressJ8a, false), ingressClass("nginx", true)}, false},
+	}
+	for _, tt := range tests {
+		s := NewServer()
+		c := fake.NewSimpleClientset()
+		for _, ic := range tt.classes {
+			c.NetworkingV1().IngressClasses().Create(context.TODO(), ic, metav1.CreateOptions{})
+		}
+		s.Kube.Client = c
+		if e := s.detectDefaultClass(context.TODO()); e != nil {
+			t.Fatalf("%v: should detect default class, got %v", tt.name, e)
+		}
+		if s.Fleets[0].servesDefault != tt.want {
+			t.Errorf("%v: want servesDefault %v, got %v", tt.name, tt.want, s.Fleets[0].servesDefault)
+		}
+	}
+}
+
+func TestMatchesClasslessIngress(t *testing.T) {
+	f := NewJ8a("")
+	igrs := ingressFor("a", "", netv1.ServiceBackendPort{Number: 80})
+	igrs.Spec.IngressClassName = nil
+
+	if f.matches(*igrs) {
+		t.Errorf("should not match ingress without class unless serving default")
+	}
+	f.servesDefault = true
+	if !f.matches(*igrs) {
+		t.Errorf("should match ingress without class when serving default")
+	}
+	igrs.Annotations = map[string]string{legacyClassAnnotation: "nginx"}
+	if f.matches(*igrs) {
+		t.Errorf("should not match ingress with legacy class annotation for another controller")
+	}
+	igrs.Annotations[legacyClassAnnotation] = f.IngressClass
+	f.servesDefault = false
+	if !f.matches(*igrs) {
+		t.Errorf("should match ingress with legacy class annotation")
+	}
+}
+
+func TestCreateIngressClassRefusesSecondDefault(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = withApply(fake.NewSimpleClientset(ingressClass("nginx", true)))
+
+	if e := s.reconcileJ8aIngressClass(context.TODO(), s.Fleets[0]); e != nil {
+		t.Fatalf("should create ingress class, got %v", e)
+	}
+	ic, _ := s.Kube.Client.NetworkingV1().IngressClasses().Get(context.TODO(), s.Fleets[0].IngressClass, metav1.GetOptions{})
+	if isDefaultClass(*ic) {
+		t.Errorf("should refuse to become second default ingress class")
+	}
+}
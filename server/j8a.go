@@ -2,250 +2,398 @@ package server
 
 import (
 	"context"
+	"crypto/sha1"
 	"fmt"
+	"github.com/simonmittag/ingress-j8a/resources"
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/intstr"
-	"os"
-	"strings"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-func int32Ptr(i int32) *int32 { return &i }
-
-func (s *Server) createOrDetectJ8aNamespace() *Server {
+const ConfigHashAnnotation = "j8a.io/config-hash"
 
-	nsName := &apiv1.Namespace{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: s.J8a.Namespace,
-		},
-	}
+func int32Ptr(i int32) *int32 { return &i }
 
-	ns, e := s.Kube.Client.CoreV1().Namespaces().
-		Create(context.Background(), nsName, metav1.CreateOptions{})
-	if e == nil {
-		s.J8a.Namespace = ns.ObjectMeta.Name
-		s.Log.Infof("created namespace '%v'", ns.ObjectMeta.Name)
-	} else {
-		ns, e := s.Kube.Client.CoreV1().Namespaces().
-			Get(context.Background(), s.J8a.Namespace, metav1.GetOptions{})
-		if ns != nil {
-			s.J8a.Namespace = ns.ObjectMeta.Name
-			s.Log.Infof("detected namespace '%v'", ns.ObjectMeta.Name)
-		}
-		if e != nil {
-			s.panic(fmt.Errorf("unable to create or namespace %v, cause: %v", s.J8a.Namespace, e))
-		}
-	}
-	return s
+func hashOf(config string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(config)))
 }
 
-func (s *Server) createOrDetectJ8aServiceTypeLoadBalancer() *Server {
-
-	servicesClient := s.Kube.Client.CoreV1().Services(s.J8a.Namespace)
-
-	// Define the service
-	service := &apiv1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      s.J8a.Service,
-			Namespace: s.J8a.Namespace,
-			Annotations: map[string]string{
-				"service.beta.kubernetes.io/aws-load-balancer-type": "nlb",
-				//"service.beta.kubernetes.io/aws-load-balancer-internal": "false",
+func (s *Server) reconcileJ8aNamespace(ctx context.Context, f *J8a) error {
+	nsClient := s.Kube.Client.CoreV1().Namespaces()
+	return s.reconcile(ctx, f, managed{
+		kind:   "namespace",
+		name:   f.Namespace,
+		shared: true,
+		want: &apiv1.Namespace{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: f.Namespace,
 			},
 		},
-		Spec: apiv1.ServiceSpec{
-			Selector: s.J8a.Pod.Label,
-			Type:     apiv1.ServiceTypeLoadBalancer,
-			Ports: []apiv1.ServicePort{
-				{
-					Name:       "http",
-					Protocol:   apiv1.ProtocolTCP,
-					Port:       80,
-					TargetPort: intstr.FromInt(80), // Assuming the pods expose port 80
-				},
-				{
-					Name:       "https",
-					Protocol:   apiv1.ProtocolTCP,
-					Port:       443,
-					TargetPort: intstr.FromInt(443), // Assuming the pods expose port 443
-				},
-			},
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return nsClient.Get(ctx, f.Namespace, metav1.GetOptions{})
 		},
-	}
-
-	result, err := servicesClient.Create(context.TODO(), service, metav1.CreateOptions{})
-	if err != nil {
-		result, err := servicesClient.Get(context.TODO(), s.J8a.Service, metav1.GetOptions{})
-		if err != nil {
-			s.Log.Fatalf("unable to create or detect service '%v', cause: %v", s.J8a.Service, err)
-		} else {
-			s.Log.Infof("detected service '%v'", result.ObjectMeta.Name)
-		}
-	} else {
-		s.Log.Infof("created service '%v'", result.GetObjectMeta().GetName())
-	}
-
-	return s
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := nsClient.Patch(ctx, f.Namespace, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
 }
 
-func (s *Server) createOrDetectJ8aDeployment() *Server {
-	var v string
-	if strings.HasPrefix(s.J8a.Version, "v") {
-		v = s.J8a.Version[1:]
-	} else {
-		v = s.J8a.Version
+// desiredDeployment is the deployment of the fleet running config.
+func (f *J8a) desiredDeployment(config string) *appsv1.Deployment {
+	image := f.image
+	if len(image) == 0 {
+		image = f.imageRef()
 	}
 
-	deploymentsClient := s.Kube.Client.AppsV1().Deployments(s.J8a.Namespace)
-
-	deployment := &appsv1.Deployment{
+	d := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      s.J8a.Deployment.Name,
-			Namespace: s.J8a.Namespace,
+			Name:      f.Deployment.Name,
+			Namespace: f.Namespace,
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: int32Ptr(int32(s.J8a.Deployment.Replicas)),
+			Replicas: int32Ptr(int32(f.Deployment.Replicas)),
 			Selector: &metav1.LabelSelector{
-				MatchLabels: s.J8a.Pod.Label,
+				MatchLabels: f.Pod.Label,
 			},
+			ProgressDeadlineSeconds: f.Deployment.ProgressDeadlineSeconds,
 			Template: apiv1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: s.J8a.Pod.Label,
+					Labels: f.Pod.Label,
+					Annotations: map[string]string{
+						ConfigHashAnnotation: hashOf(config),
+					},
 				},
-				Spec: apiv1.PodSpec{
-					Containers: []apiv1.Container{
+				Spec: f.Pod.podSpec(apiv1.Container{
+					Name:  f.Pod.Name,
+					Image: image,
+					Ports: []apiv1.ContainerPort{
+						{
+							Name:          "http",
+							Protocol:      apiv1.ProtocolTCP,
+							ContainerPort: 80,
+						},
 						{
-							Name:  s.J8a.Pod.Name,
-							Image: s.J8a.Image + ":" + v,
-							Ports: []apiv1.ContainerPort{
-								{
-									Name:          "http",
-									Protocol:      apiv1.ProtocolTCP,
-									ContainerPort: 80,
-								},
-								{
-									Name:          "https",
-									Protocol:      apiv1.ProtocolTCP,
-									ContainerPort: 443,
-								},
-							},
-							Env: []apiv1.EnvVar{{
-								Name:  "J8ACFG_YML",
-								Value: getInitialJ8aConfig(),
-							}},
+							Name:          "https",
+							Protocol:      apiv1.ProtocolTCP,
+							ContainerPort: 443,
 						},
 					},
-				},
+					Env: []apiv1.EnvVar{{
+						Name:  "J8ACFG_YML",
+						Value: config,
+					}},
+				}),
 			},
 		},
 	}
+	d.Spec.Template.Spec.ImagePullSecrets = f.imagePullSecrets()
+	return d
+}
 
-	result, err := deploymentsClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
-	if err != nil {
-		result, err := deploymentsClient.Get(context.TODO(), s.J8a.Deployment.Name, metav1.GetOptions{})
-		if err != nil {
-			s.Log.Fatalf("unable to create or detect deployment '%v', cause: %v", s.J8a.Deployment.Name, err)
-		} else {
-			s.Log.Infof("detected deployment '%v'", result.ObjectMeta.Name)
-			r := int(*result.Spec.Replicas)
-			if r != s.J8a.Deployment.Replicas {
+// reconcileJ8aDeployment applies the deployment with the config last rolled out. On first contact with an existing
+// deployment it adopts the live scale and config, so a controller restart does not roll pods. With an autoscaler the
+// replicas are handed over once the deployment exists and not applied any more.
+func (s *Server) reconcileJ8aDeployment(ctx context.Context, f *J8a) error {
+	deploymentsClient := s.Kube.Client.AppsV1().Deployments(f.Namespace)
+	live, e := deploymentsClient.Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if e != nil && !errors.IsNotFound(e) {
+		return fmt.Errorf("unable to fetch deployment '%v', cause: %v", f.Deployment.Name, e)
+	}
+	found := e == nil
+	if len(f.config) == 0 {
+		f.config = getInitialJ8aConfig()
+		if found {
+			s.Log.Infof("detected deployment '%v'", live.ObjectMeta.Name)
+			if live.Spec.Replicas != nil && int(*live.Spec.Replicas) != f.Deployment.Replicas && !s.autoscaled(f) {
 				//remember the current deployment scale of j8a
-				s.J8a.Deployment.Replicas = r
-				s.Log.Infof("j8a replicas configuration set to %v based on current value of deployment '%v'", r, result.ObjectMeta.Name)
+				f.Deployment.Replicas = int(*live.Spec.Replicas)
+				s.Log.Infof("j8a replicas configuration set to %v based on current value of deployment '%v'", f.Deployment.Replicas, live.ObjectMeta.Name)
+			}
+			c := liveConfig(live, f.Pod.Name)
+			if s.Features.ConfigFile {
+				c = s.liveConfigFile(ctx, f, live)
+			}
+			if len(c) > 0 {
+				f.config = c
+			}
+		}
+		f.adoptedConfig = f.config
+		f.image = f.imageRef()
+		if found {
+			for _, c := range live.Spec.Template.Spec.Containers {
+				if c.Name == f.Pod.Name {
+					f.image = c.Image
+				}
 			}
 		}
+	}
+
+	want := f.desiredDeployment(f.config)
+	if s.Features.ConfigFile {
+		if e := s.reconcileJ8aConfigFile(ctx, f, f.config); e != nil {
+			return e
+		}
+		f.withConfigFile(want, f.config)
+	}
+	if s.autoscaled(f) {
+		want.Spec.Replicas = int32Ptr(int32(f.Deployment.Autoscaling.withDefaults().MinReplicas))
+		if found {
+			if !f.replicasHandedOver && live.Spec.Replicas != nil {
+				if e := s.handoverReplicas(ctx, f, *live.Spec.Replicas); e != nil {
+					return e
+				}
+				f.replicasHandedOver = true
+			}
+			want.Spec.Replicas = nil
+		}
 	} else {
-		s.Log.Infof("created deployment '%v'", result.GetObjectMeta().GetName())
+		f.replicasHandedOver = false
 	}
 
-	return s
+	e = s.reconcile(ctx, f, managed{
+		kind: "deployment",
+		name: f.Deployment.Name,
+		want: want,
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return deploymentsClient.Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := deploymentsClient.Patch(ctx, f.Deployment.Name, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+	if e == nil && s.Features.ConfigFile && f.rollout == nil && f.canary == nil {
+		s.cleanupJ8aConfigFiles(ctx, f, f.config)
+	}
+	return e
+}
+
+// liveConfig is the j8a config of the running deployment, empty if there is none.
+func liveConfig(d *appsv1.Deployment, container string) string {
+	for _, c := range d.Spec.Template.Spec.Containers {
+		if c.Name != container {
+			continue
+		}
+		for _, ev := range c.Env {
+			if ev.Name == "J8ACFG_YML" {
+				return ev.Value
+			}
+		}
+	}
+	return ""
 }
 
-func (s *Server) createOrDetectJ8aIngressClass() *Server {
+func (s *Server) reconcileJ8aIngressClass(ctx context.Context, f *J8a) error {
 	ingressClassClient := s.Kube.Client.NetworkingV1().IngressClasses()
 
-	// Create the IngressClass resource
+	//refuse to become a second default, kube would reject ingress without class as ambiguous.
+	isDefault := f.DefaultClass != nil && *f.DefaultClass
+	if isDefault {
+		foreign, e := s.foreignDefaultClasses(ctx)
+		if e != nil {
+			return e
+		}
+		if len(foreign) > 0 {
+			isDefault = false
+			s.Log.Errorf("refusing to mark ingressClass '%v' as default, cluster default is already %v", f.IngressClass, foreign)
+		}
+	}
+
 	ingressClass := &netv1.IngressClass{
+		TypeMeta: metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "IngressClass"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "ingress-j8a",
+			Name: f.IngressClass,
 			Annotations: map[string]string{
-				"ingressclass.kubernetes.io/is-default-class": "true",
+				defaultClassAnnotation: fmt.Sprintf("%v", isDefault),
 			},
 		},
 		Spec: netv1.IngressClassSpec{
 			//TODO: what does this point to? the docker image name?
 			Controller: "github.com/simonmittag/ingress-j8a",
+			Parameters: s.ingressClassParameters(f),
 		},
 	}
 
-	// Create the IngressClass using the client
-	ic, err := ingressClassClient.Create(context.TODO(), ingressClass, metav1.CreateOptions{})
-	if err != nil {
-		result, err := ingressClassClient.Get(context.TODO(), "ingress-j8a", metav1.GetOptions{})
-		if err != nil {
-			s.Log.Fatalf("unable to create or detect ingress class '%v', cause %v", s.J8a.Deployment.Name, err)
-		} else {
-			s.Log.Infof("detected ingressClass '%v'", result.ObjectMeta.Name)
-		}
-	} else {
-		s.Log.Infof("created ingressClass '%v'", ic.ObjectMeta.Name)
-	}
-
-	return s
+	return s.reconcile(ctx, f, managed{
+		kind: "ingressClass",
+		name: f.IngressClass,
+		want: ingressClass,
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return ingressClassClient.Get(ctx, f.IngressClass, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := ingressClassClient.Patch(ctx, f.IngressClass, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
 }
 
 // TODO: this may not work in the future but for initial config.
 // server cannot process listener callbacks while this is running (but it could queue them)
-func (s *Server) updateJ8aDeploymentWithFullClusterConfig() {
-	il, _ := s.fetchIngress()
-	s.updateCacheFromIngressList(il)
+func (s *Server) updateJ8aDeploymentWithFullClusterConfig(ctx context.Context) error {
+	if e := s.detectDefaultClass(ctx); e != nil {
+		return e
+	}
+	il, e := s.fetchIngress(ctx)
+	if e != nil {
+		return fmt.Errorf("unable to fetch ingress, cause: %v", e)
+	}
+	s.updateCacheFromIngressList(ctx, il)
 
-	// get services
-	// get secrets
+	for _, f := range s.Fleets {
+		s.updateParams(ctx, f)
+		if e := s.reconcileJ8aObjects(ctx, f); e != nil {
+			return e
+		}
+		if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+			return e
+		}
+		s.issueAcmeCertificate(ctx, f)
+	}
+	return nil
 }
 
-func (s *Server) updateCacheFromIngressList(il *netv1.IngressList) {
+// reconcileJ8aObjects restores namespace, ingressClass, service, scaling and networkPolicy objects of the fleet. The
+// networkPolicy follows the route cache, so it is not applied before the cache is filled. The deployment is reconciled
+// together with its config in rolloutJ8aConfig.
+func (s *Server) reconcileJ8aObjects(ctx context.Context, f *J8a) error {
+	for _, r := range []func(context.Context, *J8a) error{
+		s.reconcileJ8aNamespace,
+		s.reconcileJ8aIngressClass,
+		s.reconcileJ8aService,
+		s.reconcileJ8aScaling,
+		s.reconcileJ8aNetworkPolicy,
+	} {
+		if e := r(ctx, f); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *Server) updateCacheFromIngressList(ctx context.Context, il *netv1.IngressList) {
+	fleetRoutes := make(map[*J8a][]Route)
 	for _, igrs := range il.Items {
-		//we only process ingress where class is specified and points to J8a. Older kube versions without
-		//ingressclass are not supported.
-		if igrs.Spec.IngressClassName != nil && *igrs.Spec.IngressClassName == s.J8a.IngressClass {
-			if db := igrs.Spec.DefaultBackend; db != nil {
-				s1 := s.fetchServiceDNSName(*db)
-				_ = s1
+		//we process ingress where class points to one of our fleets, or without class if that fleet is the
+		//cluster default.
+		if f := s.fleetFor(igrs); f != nil {
+			routes, e := s.translateIngress(ctx, igrs)
+			if e != nil {
+				s.Log.Errorf("rejected ingress '%v/%v', cause: %v", igrs.Namespace, igrs.Name, e)
+				s.event(&igrs, apiv1.EventTypeWarning, "Rejected", "ingress not routed by j8a, cause: %v", e)
+				continue
 			}
-			for _, r := range igrs.Spec.Rules {
-				if r.HTTP != nil {
-					for _, b := range r.HTTP.Paths {
-						//TODO: these routes need hashed, then cached as resources.
-						s1 := s.fetchServiceDNSName(b.Backend)
-						//TODO: find a named service port if it is available, then look up the name and port.
-						//TODO: if this fails, skip the faulty ingress resource, don't include in config
-						po, e := s.FetchBackendServicePort(b.Backend)
-						_ = po
-						_ = e
-						jr := *NewRouteFrom(b.Path,
-							r.Host,
-							b.PathType,
-							s1)
+			fleetRoutes[f] = append(fleetRoutes[f], routes...)
+		}
+	}
+	//the full route table replaces the previous one, fleets without ingress are left with no routes.
+	for _, f := range s.Fleets {
+		f.Cache.update(append(s.acmeRoutes(fleetRoutes[f]), fleetRoutes[f]...))
+	}
+}
 
-						s.Cache.update(jr)
+// fleetFor splits ingress resources by ingressClassName, nil if none of our fleets serves the ingress.
+func (s *Server) fleetFor(igrs netv1.Ingress) *J8a {
+	for _, f := range s.Fleets {
+		if f.matches(igrs) {
+			return f
+		}
+	}
+	return nil
+}
 
+// matches ingress by ingressClassName, the legacy annotation, or no class at all if j is the cluster default.
+func (j *J8a) matches(igrs netv1.Ingress) bool {
+	if igrs.Spec.IngressClassName != nil {
+		return *igrs.Spec.IngressClassName == j.IngressClass
+	}
+	if lc, ok := igrs.Annotations[legacyClassAnnotation]; ok {
+		return lc == j.IngressClass
+	}
+	return j.servesDefault
+}
+
+// translateIngress converts all paths of an ingress into j8a routes. A single backend that cannot be
+// resolved rejects the whole ingress, so it never shows up half-configured.
+func (s *Server) translateIngress(ctx context.Context, igrs netv1.Ingress) ([]Route, error) {
+	routes := make([]Route, 0)
+	settings, scheme, e := parseIngressAnnotations(igrs.Annotations)
+	if e != nil {
+		return nil, e
+	}
+	jwt, e := s.parseJwtAnnotations(ctx, igrs.Namespace, igrs.Name, igrs.Annotations)
+	if e != nil {
+		return nil, e
+	}
+	acme := false
+	if f := s.fleetFor(igrs); f != nil {
+		if acme, e = f.acmeFor(igrs.Annotations); e != nil {
+			return nil, e
+		}
+	}
+	acmeHosts := make(map[string]bool)
+	tlsSecrets := make(map[string]string)
+	for _, t := range igrs.Spec.TLS {
+		if len(t.SecretName) == 0 {
+			for _, h := range t.Hosts {
+				acmeHosts[h] = acme
+			}
+			continue
+		}
+		for _, h := range t.Hosts {
+			tlsSecrets[h] = igrs.Namespace + "/" + t.SecretName
+		}
+		//without hosts the secret applies to all hosts of the ingress not listed elsewhere
+		if len(t.Hosts) == 0 {
+			tlsSecrets["*"] = igrs.Namespace + "/" + t.SecretName
+		}
+	}
+	if db := igrs.Spec.DefaultBackend; db != nil {
+		if _, e := s.fetchBackendServicePort(ctx, igrs.Namespace, *db); e != nil {
+			return nil, e
+		}
+	}
+	for _, r := range igrs.Spec.Rules {
+		if r.HTTP != nil {
+			for _, b := range r.HTTP.Paths {
+				//TODO: these routes need hashed, then cached as resources.
+				port, e := s.fetchBackendServicePort(ctx, igrs.Namespace, b.Backend)
+				if e != nil {
+					return nil, e
+				}
+				s1 := serviceDNSName(igrs.Namespace, b.Backend)
+				jr := NewRouteFrom(b.Path,
+					r.Host,
+					b.PathType,
+					s1).WithUpstream(s1, port).WithScheme(scheme)
+				jr.Settings = settings
+				jr.JWT = jwt
+				jr.ACME = acmeHosts[r.Host]
+				jr.Ingress = igrs.Namespace + "/" + igrs.Name
+				jr.IngressUID = igrs.UID
+				if len(r.Host) > 0 && !jr.ACME {
+					if sec, ok := tlsSecrets[r.Host]; ok {
+						jr.TLSSecret = sec
+					} else {
+						jr.TLSSecret = tlsSecrets["*"]
 					}
 				}
+				routes = append(routes, *jr)
 			}
 		}
 	}
+	return routes, nil
 }
 
 func getTemplateJ8aConfig() string {
-	f := "resources/j8a/configtemplate.yml"
-	t, e := os.ReadFile(f)
-	if e != nil {
-		t, _ = os.ReadFile("../" + f)
-	}
-	return string(t)
+	return resources.J8aConfigTemplate
 }
 
 func getInitialJ8aConfig() string {
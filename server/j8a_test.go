@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes/fake"
 	"os"
@@ -12,28 +15,36 @@ import (
 	"text/template"
 )
 
-func TestCreateOrDetectNamespace(t *testing.T) {
+func TestReconcileJ8aNamespace(t *testing.T) {
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
-	s.createOrDetectJ8aNamespace()
+	s.Kube.Client = withApply(fake.NewSimpleClientset())
+	if e := s.reconcileJ8aNamespace(context.TODO(), s.Fleets[0]); e != nil {
+		t.Errorf("should create with fake client, got %v", e)
+	}
 }
 
-func TestCreateOrDetectServiceTypeLoadBalancer(t *testing.T) {
+func TestReconcileJ8aServiceTypeLoadBalancer(t *testing.T) {
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
-	s.createOrDetectJ8aServiceTypeLoadBalancer()
+	s.Kube.Client = withApply(fake.NewSimpleClientset())
+	if e := s.reconcileJ8aService(context.TODO(), s.Fleets[0]); e != nil {
+		t.Errorf("should create with fake client, got %v", e)
+	}
 }
 
-func TestCreateOrDetectJ8aDeployment(t *testing.T) {
+func TestReconcileJ8aDeployment(t *testing.T) {
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
-	s.createOrDetectJ8aDeployment()
+	s.Kube.Client = withApply(fake.NewSimpleClientset())
+	if e := s.reconcileJ8aDeployment(context.TODO(), s.Fleets[0]); e != nil {
+		t.Errorf("should create with fake client, got %v", e)
+	}
 }
 
-func TestCreateOrDetectJ8aIngressClass(t *testing.T) {
+func TestReconcileJ8aIngressClass(t *testing.T) {
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
-	s.createOrDetectJ8aIngressClass()
+	s.Kube.Client = withApply(fake.NewSimpleClientset())
+	if e := s.reconcileJ8aIngressClass(context.TODO(), s.Fleets[0]); e != nil {
+		t.Errorf("should create with fake client, got %v", e)
+	}
 }
 
 func TestJ8aReadInitialConfig(t *testing.T) {
@@ -67,10 +78,11 @@ func TestJ8aReadConfigFile(t *testing.T) {
 		t.Errorf("should have parsed config without error, got: %v", err)
 	}
 
-	data := map[string]interface{}{
-		"TLS":       "",
-		"ROUTES":    "- path: /\n    host: www.emoji😊😊😊.org\n    resource: upstreamresource",
-		"RESOURCES": "upstreamresource:\n    - url:\n        scheme: http://\n        host: localhost\n        port: 60083",
+	data := j8aTemplate{
+		TLS:       "",
+		ROUTES:    "- path: /\n    host: www.emoji😊😊😊.org\n    resource: upstreamresource",
+		RESOURCES: "upstreamresource:\n    - url:\n        scheme: http://\n        host: localhost\n        port: 60083",
+		Params:    DefaultParams(),
 	}
 
 	var output strings.Builder
@@ -137,3 +149,62 @@ func locateJ8a() (string, error) {
 	}
 	return j8a_path, err
 }
+
+func TestBootstrapFleets(t *testing.T) {
+	s := NewServer()
+	c := newFakeClientset()
+	s.Kube.Client = c
+	s.Fleets = []*J8a{NewJ8a("public"), NewJ8a("internal")}
+
+	if e := s.Bootstrap(context.TODO()); e != nil {
+		t.Fatalf("should bootstrap fleets, got %v", e)
+	}
+	for _, f := range s.Fleets {
+		if _, e := c.AppsV1().Deployments(f.Namespace).Get(context.TODO(), f.Deployment.Name, metav1.GetOptions{}); e != nil {
+			t.Errorf("want deployment for fleet %v, got %v", f, e)
+		}
+		if _, e := c.CoreV1().Services(f.Namespace).Get(context.TODO(), f.Service, metav1.GetOptions{}); e != nil {
+			t.Errorf("want service for fleet %v, got %v", f, e)
+		}
+		if _, e := c.NetworkingV1().IngressClasses().Get(context.TODO(), f.IngressClass, metav1.GetOptions{}); e != nil {
+			t.Errorf("want ingressClass for fleet %v, got %v", f, e)
+		}
+	}
+}
+
+func TestUpdateCacheSplitsIngressByClass(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	pub, internal := NewJ8a("public"), NewJ8a("internal")
+	s.Fleets = []*J8a{pub, internal}
+
+	il := &netv1.IngressList{Items: []netv1.Ingress{
+		*ingressFor("a", pub.IngressClass, netv1.ServiceBackendPort{Number: 80}),
+		*ingressFor("b", internal.IngressClass, netv1.ServiceBackendPort{Number: 80}),
+		*ingressFor("c", internal.IngressClass, netv1.ServiceBackendPort{Number: 80}),
+		*ingressFor("d", "nginx", netv1.ServiceBackendPort{Number: 80}),
+	}}
+	s.updateCacheFromIngressList(context.TODO(), il)
+
+	latest := func(c *Cache) int { return len(c.Mementos[len(c.Mementos)-1].Routes) }
+	if got := latest(pub.Cache); got != 1 {
+		t.Errorf("want 1 route in public fleet, got %v", got)
+	}
+	if got := latest(internal.Cache); got != 2 {
+		t.Errorf("want 2 routes in internal fleet, got %v", got)
+	}
+}
+
+func TestTranslateIngressUsesItsNamespace(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	igrs := ingressFor("a", s.Fleets[0].IngressClass, netv1.ServiceBackendPort{Number: 80})
+	igrs.Namespace = "team"
+	routes, e := s.translateIngress(context.TODO(), *igrs)
+	if e != nil {
+		t.Fatalf("should translate ingress, got %v", e)
+	}
+	if routes[0].Upstream.Host != "s1.team.svc.cluster.local" {
+		t.Errorf("upstream should be the service in the namespace of the ingress, got %v", routes[0].Upstream.Host)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ingress annotations for jwt validation of all routes of the ingress.
+const (
+	JwtAlgAnnotation     = annotationPrefix + "jwt-alg"
+	JwtKeyAnnotation     = annotationPrefix + "jwt-key"
+	JwtJwksURLAnnotation = annotationPrefix + "jwt-jwks-url"
+	JwtSecretAnnotation  = annotationPrefix + "jwt-secret"
+	JwtClaimsAnnotation  = annotationPrefix + "jwt-claims"
+	JwtSkewAnnotation    = annotationPrefix + "jwt-acceptable-skew-seconds"
+
+	// jwtSecretKey is the key in the referenced secret that holds the public key or shared secret.
+	jwtSecretKey = "key"
+)
+
+var jwtAlgs = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"HS256": true, "HS384": true, "HS512": true,
+}
+
+// JWT is a named jwt config in j8a, referenced by routes.
+type JWT struct {
+	Name                  string
+	Alg                   string
+	Key                   string
+	JwksURL               string
+	AcceptableSkewSeconds int
+	Claims                []string
+}
+
+// jwtName is unique per ingress. Names are joined with a dash, which namespaces and names may contain too, so the
+// hash of namespace/name tells i.e. a-b/c from a/b-c.
+func jwtName(namespace string, name string) string {
+	return namespace + "-" + name + "-" + hashOf(namespace + "/" + name)[:8]
+}
+
+func isJwtAnnotation(k string) bool {
+	return strings.HasPrefix(k, annotationPrefix+"jwt-")
+}
+
+// parseJwtAnnotations builds the jwt config of an ingress, nil if it has none. A key in a secret is read from the
+// namespace of the ingress, so teams can only reference their own secrets.
+func (s *Server) parseJwtAnnotations(ctx context.Context, namespace string, name string, annotations map[string]string) (*JWT, error) {
+	alg, ok := annotations[JwtAlgAnnotation]
+	if !ok {
+		for k := range annotations {
+			if isJwtAnnotation(k) {
+				return nil, fmt.Errorf("annotation '%v' needs '%v'", k, JwtAlgAnnotation)
+			}
+		}
+		return nil, nil
+	}
+	if !jwtAlgs[alg] {
+		return nil, fmt.Errorf("invalid annotation '%v', unsupported alg '%v'", JwtAlgAnnotation, alg)
+	}
+
+	j := &JWT{
+		Name: jwtName(namespace, name),
+		Alg:  alg,
+	}
+
+	sources := 0
+	if k, ok := annotations[JwtKeyAnnotation]; ok {
+		j.Key = k
+		sources++
+	}
+	if u, ok := annotations[JwtJwksURLAnnotation]; ok {
+		pu, e := url.Parse(u)
+		if e != nil || (pu.Scheme != "https" && pu.Scheme != "http") || len(pu.Host) == 0 {
+			return nil, fmt.Errorf("invalid annotation '%v', want http(s) url, got '%v'", JwtJwksURLAnnotation, u)
+		}
+		j.JwksURL = u
+		sources++
+	}
+	if sn, ok := annotations[JwtSecretAnnotation]; ok {
+		sec, e := s.getSecret(ctx, namespace, sn)
+		if e != nil {
+			return nil, fmt.Errorf("unable to fetch jwt secret '%v/%v', cause: %v", namespace, sn, e)
+		}
+		k, ok := sec.Data[jwtSecretKey]
+		if !ok || len(k) == 0 {
+			return nil, fmt.Errorf("jwt secret '%v/%v' has no data key '%v'", namespace, sn, jwtSecretKey)
+		}
+		j.Key = string(k)
+		sources++
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("jwt alg '%v' needs exactly one of '%v', '%v' or '%v'", alg, JwtKeyAnnotation, JwtJwksURLAnnotation, JwtSecretAnnotation)
+	}
+	if len(j.Key) > 0 && !strings.HasPrefix(alg, "HS") {
+		if b, _ := pem.Decode([]byte(j.Key)); b == nil {
+			return nil, fmt.Errorf("jwt key for alg '%v' is not a pem encoded public key", alg)
+		}
+	}
+	if len(j.JwksURL) > 0 && strings.HasPrefix(alg, "HS") {
+		return nil, fmt.Errorf("jwt alg '%v' cannot use '%v'", alg, JwtJwksURLAnnotation)
+	}
+
+	if v, ok := annotations[JwtSkewAnnotation]; ok {
+		i, e := strconv.Atoi(v)
+		if e != nil || i < 0 {
+			return nil, fmt.Errorf("invalid annotation '%v', want seconds, got '%v'", JwtSkewAnnotation, v)
+		}
+		j.AcceptableSkewSeconds = i
+	}
+	//one claim per line, claims are expressions that may contain commas.
+	for _, c := range strings.Split(annotations[JwtClaimsAnnotation], "\n") {
+		if c = strings.TrimSpace(c); len(c) > 0 {
+			j.Claims = append(j.Claims, c)
+		}
+	}
+	return j, nil
+}
+
+// creates an indented yaml string
+func (j *JWT) String() string {
+	var b strings.Builder
+
+	b.WriteString(fmt.Sprintf("\n  %s:", j.Name))
+	b.WriteString(fmt.Sprintf("\n    alg: %s", j.Alg))
+	if len(j.Key) > 0 {
+		b.WriteString("\n    key: |")
+		for _, l := range strings.Split(strings.TrimSpace(j.Key), "\n") {
+			b.WriteString(fmt.Sprintf("\n      %s", l))
+		}
+	}
+	if len(j.JwksURL) > 0 {
+		b.WriteString(fmt.Sprintf("\n    jwksUrl: %s", j.JwksURL))
+	}
+	if j.AcceptableSkewSeconds > 0 {
+		b.WriteString(fmt.Sprintf("\n    acceptableSkewSeconds: %d", j.AcceptableSkewSeconds))
+	}
+	if len(j.Claims) > 0 {
+		b.WriteString("\n    claims:")
+		for _, c := range j.Claims {
+			b.WriteString(fmt.Sprintf("\n      - %s", strconv.Quote(c)))
+		}
+	}
+
+	return b.String()
+}
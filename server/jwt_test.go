@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"strings"
+	"testing"
+)
+
+const testPublicKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEEVs/o5+uQbTjL3chynL4wXgUg2R9
+q9UU8I5mEovUf86QZ7kOBIjJwqnzD1omageEHWwHdBO6B+dFabmdT9POxg==
+-----END PUBLIC KEY-----`
+
+func TestParseJwtAnnotations(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	s.Kube.Client.CoreV1().Secrets("default").Create(context.TODO(), &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "jwt", Namespace: "default"},
+		Data:       map[string][]byte{jwtSecretKey: []byte(testPublicKey)},
+	}, metav1.CreateOptions{})
+
+	j, e := s.parseJwtAnnotations(context.TODO(), "default", "api", map[string]string{
+		JwtAlgAnnotation:    "ES256",
+		JwtSecretAnnotation: "jwt",
+		JwtClaimsAnnotation: ".aud == \"api\"\n.iss == \"me\"\n",
+	})
+	if e != nil {
+		t.Fatalf("should parse jwt annotations, got %v", e)
+	}
+	if j.Name != jwtName("default", "api") || j.Key != testPublicKey || len(j.Claims) != 2 {
+		t.Errorf("unexpected jwt %+v", j)
+	}
+
+	if j, e := s.parseJwtAnnotations(context.TODO(), "default", "api", nil); j != nil || e != nil {
+		t.Errorf("ingress without jwt annotations should have no jwt, got %v %v", j, e)
+	}
+
+	for _, bad := range []map[string]string{
+		{JwtAlgAnnotation: "RS1"},
+		{JwtAlgAnnotation: "RS256"},
+		{JwtAlgAnnotation: "RS256", JwtKeyAnnotation: "notpem"},
+		{JwtAlgAnnotation: "RS256", JwtKeyAnnotation: testPublicKey, JwtJwksURLAnnotation: "https://idp/jwks"},
+		{JwtAlgAnnotation: "RS256", JwtJwksURLAnnotation: "idp/jwks"},
+		{JwtAlgAnnotation: "RS256", JwtSecretAnnotation: "doesnotexist"},
+		{JwtAlgAnnotation: "HS256", JwtJwksURLAnnotation: "https://idp/jwks"},
+		{JwtAlgAnnotation: "none"},
+		{JwtJwksURLAnnotation: "https://idp/jwks"},
+	} {
+		if _, e := s.parseJwtAnnotations(context.TODO(), "default", "api", bad); e == nil {
+			t.Errorf("should reject jwt annotations %v", bad)
+		}
+	}
+}
+
+func TestJwtNameIsUniquePerIngress(t *testing.T) {
+	if jwtName("a-b", "c") == jwtName("a", "b-c") {
+		t.Errorf("jwt names of different ingress should differ, got %v", jwtName("a", "b-c"))
+	}
+}
+
+func TestRenderJwt(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+
+	igrs := ingressFor("api", f.IngressClass, netv1.ServiceBackendPort{Number: 80})
+	igrs.Annotations = map[string]string{
+		JwtAlgAnnotation:     "RS256",
+		JwtJwksURLAnnotation: "https://idp.example.com/.well-known/jwks.json",
+		JwtSkewAnnotation:    "60",
+		JwtClaimsAnnotation:  ".sub",
+	}
+	s.updateCacheFromIngressList(context.TODO(), &netv1.IngressList{Items: []netv1.Ingress{*igrs}})
+
+	c, e := renderJ8aConfig(f, "")
+	if e != nil {
+		t.Fatalf("should render config, got %v", e)
+	}
+	m := make(map[string]interface{})
+	if e := yaml.Unmarshal([]byte(c), &m); e != nil {
+		t.Fatalf("rendered config should be yaml, got %v\n%v", e, c)
+	}
+	name := jwtName("default", "api")
+	jwt, ok := m["jwt"].(map[string]interface{})[name].(map[string]interface{})
+	if !ok || jwt["jwksUrl"] != "https://idp.example.com/.well-known/jwks.json" {
+		t.Errorf("config should contain jwt section, got\n%v", c)
+	}
+	if !strings.Contains(c, "jwt: "+name) {
+		t.Errorf("route should reference jwt, got\n%v", c)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"strings"
+)
+
+type Kube struct {
+	Client       kubernetes.Interface
+	Config       *rest.Config
+	Auth         *Auth
+	Version      KVersion
+	Capabilities Capabilities
+}
+
+type KVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseKVersion reads the gitVersion reported by the apiserver. Vendor suffixes such as v1.27.3-eks-a5565ad or
+// v1.27.3-gke.100 are ignored, they do not make the version older than v1.27.3.
+func ParseKVersion(gitVersion string) (KVersion, error) {
+	v, e := version.ParseGeneric(gitVersion)
+	if e != nil {
+		return KVersion{}, fmt.Errorf("unable to parse Kubernetes version '%v', cause: %v", gitVersion, e)
+	}
+	return KVersion{
+		Major: int(v.Major()),
+		Minor: int(v.Minor()),
+		Patch: int(v.Patch()),
+	}, nil
+}
+
+func (v KVersion) AtLeast(min KVersion) bool {
+	if v.Major != min.Major {
+		return v.Major > min.Major
+	}
+	if v.Minor != min.Minor {
+		return v.Minor > min.Minor
+	}
+	return v.Patch >= min.Patch
+}
+
+func (v KVersion) String() string {
+	return fmt.Sprintf("%v.%v.%v", v.Major, v.Minor, v.Patch)
+}
+
+// Capabilities is the feature matrix of the cluster, detected from version and discovery. Controller features
+// that depend on optional APIs are switched on or off from here.
+type Capabilities struct {
+	EndpointSliceV1    bool `json:"endpointSliceV1"`
+	IngressClassParams bool `json:"ingressClassParams"`
+	GatewayAPI         bool `json:"gatewayAPI"`
+	ServerSideApply    bool `json:"serverSideApply"`
+	AutoscalingV2      bool `json:"autoscalingV2"`
+}
+
+var (
+	// spec.parameters.scope and namespace on IngressClass went GA in 1.23
+	ingressClassParamsMinimum = KVersion{Major: 1, Minor: 23}
+	// server side apply went GA in 1.22
+	serverSideApplyMinimum = KVersion{Major: 1, Minor: 22}
+)
+
+func (s *Server) detectKubeVersion() error {
+	vi, e := s.Kube.Client.Discovery().ServerVersion()
+	if e != nil {
+		return fmt.Errorf("unable to detect Kubernetes version, cause: %v", e)
+	}
+	v, e := ParseKVersion(vi.GitVersion)
+	if e != nil {
+		return e
+	}
+	s.Kube.Version = v
+	return nil
+}
+
+func (s *Server) detectCapabilities() {
+	dc := s.Kube.Client.Discovery()
+	s.Kube.Capabilities = Capabilities{
+		EndpointSliceV1: hasResource(dc.ServerResourcesForGroupVersion, "discovery.k8s.io/v1", "endpointslices"),
+		IngressClassParams: s.Kube.Version.AtLeast(ingressClassParamsMinimum) &&
+			hasResource(dc.ServerResourcesForGroupVersion, "networking.k8s.io/v1", "ingressclasses"),
+		ServerSideApply: s.Kube.Version.AtLeast(serverSideApplyMinimum),
+		AutoscalingV2:   hasResource(dc.ServerResourcesForGroupVersion, "autoscaling/v2", "horizontalpodautoscalers"),
+	}
+	if gl, e := dc.ServerGroups(); e == nil {
+		for _, g := range gl.Groups {
+			if g.Name == "gateway.networking.k8s.io" {
+				s.Kube.Capabilities.GatewayAPI = true
+			}
+		}
+	}
+}
+
+func hasResource(lookup func(string) (*metav1.APIResourceList, error), groupVersion string, resource string) bool {
+	rl, e := lookup(groupVersion)
+	if e != nil || rl == nil {
+		return false
+	}
+	for _, r := range rl.APIResources {
+		if r.Name == resource {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Capabilities) String() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("endpointSliceV1=%v ", c.EndpointSliceV1))
+	b.WriteString(fmt.Sprintf("ingressClassParams=%v ", c.IngressClassParams))
+	b.WriteString(fmt.Sprintf("gatewayAPI=%v ", c.GatewayAPI))
+	b.WriteString(fmt.Sprintf("serverSideApply=%v ", c.ServerSideApply))
+	b.WriteString(fmt.Sprintf("autoscalingV2=%v", c.AutoscalingV2))
+	return b.String()
+}
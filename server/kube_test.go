@@ -0,0 +1,85 @@
+package server
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestParseKVersion(t *testing.T) {
+	tests := []struct {
+		gitVersion string
+		want       KVersion
+	}{
+		{"v1.27.3", KVersion{1, 27, 3}},
+		{"v1.27.3-eks-a5565ad", KVersion{1, 27, 3}},
+		{"v1.26.5-gke.1200", KVersion{1, 26, 5}},
+		{"v1.25.0+k3s1", KVersion{1, 25, 0}},
+		{"v2.0.0", KVersion{2, 0, 0}},
+	}
+	for _, tt := range tests {
+		got, e := ParseKVersion(tt.gitVersion)
+		if e != nil || got != tt.want {
+			t.Errorf("parse %v want %v, got %v, err %v", tt.gitVersion, tt.want, got, e)
+		}
+	}
+
+	if _, e := ParseKVersion("27+"); e == nil {
+		t.Errorf("should not parse version without major")
+	}
+}
+
+func TestKVersionAtLeast(t *testing.T) {
+	min := KubeVersionMinimum.Version
+	if !(KVersion{2, 0, 0}).AtLeast(min) {
+		t.Errorf("2.0 should satisfy minimum %v", min)
+	}
+	if !(KVersion{1, 22, 0}).AtLeast(min) {
+		t.Errorf("1.22 should satisfy minimum %v", min)
+	}
+	if (KVersion{1, 21, 14}).AtLeast(min) {
+		t.Errorf("1.21 should not satisfy minimum %v", min)
+	}
+	if (KVersion{0, 30, 0}).AtLeast(min) {
+		t.Errorf("0.30 should not satisfy minimum %v", min)
+	}
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	s := NewServer()
+	c := fake.NewSimpleClientset()
+	fd := c.Discovery().(*fakediscovery.FakeDiscovery)
+	fd.FakedServerVersion = &version.Info{GitVersion: "v1.27.3-eks-a5565ad"}
+	fd.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "discovery.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "endpointslices"}}},
+		{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "ingressclasses"}}},
+		{GroupVersion: "autoscaling/v2", APIResources: []metav1.APIResource{{Name: "horizontalpodautoscalers"}}},
+	}
+	s.Kube.Client = c
+
+	if e := s.detectKubeVersion(); e != nil {
+		t.Fatalf("should detect version, got %v", e)
+	}
+	s.detectCapabilities()
+
+	want := Capabilities{
+		EndpointSliceV1:    true,
+		IngressClassParams: true,
+		GatewayAPI:         false,
+		ServerSideApply:    true,
+		AutoscalingV2:      true,
+	}
+	if s.Kube.Capabilities != want {
+		t.Errorf("want capabilities %v, got %v", want, s.Kube.Capabilities)
+	}
+
+	fd.Resources = append(fd.Resources, &metav1.APIResourceList{
+		GroupVersion: "gateway.networking.k8s.io/v1beta1", APIResources: []metav1.APIResource{{Name: "gateways"}},
+	})
+	s.detectCapabilities()
+	if !s.Kube.Capabilities.GatewayAPI {
+		t.Errorf("should detect gateway api")
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"time"
+)
+
+const (
+	leaseNamespaceEnv = "POD_NAMESPACE"
+	progressPeriod    = time.Second * 10
+)
+
+type LeaderElection struct {
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+func NewLeaderElection() *LeaderElection {
+	ns := os.Getenv(leaseNamespaceEnv)
+	if len(ns) == 0 {
+		ns = "default"
+	}
+	id, _ := os.Hostname()
+	return &LeaderElection{
+		Namespace:     ns,
+		Name:          "ingress-j8a",
+		Identity:      id + "_" + string(uuid.NewUUID()),
+		LeaseDuration: time.Second * 15,
+		RenewDeadline: time.Second * 10,
+		RetryPeriod:   time.Second * 2,
+	}
+}
+
+var errLostLease = errors.New("lost leader lease")
+
+// Run authenticates, then bootstraps and runs the daemon until ctx is cancelled. With leader election enabled only
+// the holder of the lease does so. On shutdown the current reconcile finishes within ShutdownGrace, then the lease
+// is released and pending events are flushed.
+func (s *Server) Run(ctx context.Context) error {
+	if e := s.authenticate(ctx); e != nil {
+		return &BootstrapError{Phase: PhaseAuth, Err: e}
+	}
+	s.startEvents()
+	defer s.stopEvents()
+	s.serveMetrics(ctx)
+	s.serveAcmeSolver(ctx)
+
+	if !s.Features.LeaderElection {
+		return s.runUntilShutdown(ctx)
+	}
+	return s.runWithLeaderElection(ctx)
+}
+
+func (s *Server) runWithLeaderElection(ctx context.Context) error {
+	result := make(chan error, 1)
+	le, e := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      s.LeaderElection.Name,
+				Namespace: s.LeaderElection.Namespace,
+			},
+			Client: s.Kube.Client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: s.LeaderElection.Identity,
+			},
+		},
+		ReleaseOnCancel: true,
+		LeaseDuration:   s.LeaderElection.LeaseDuration,
+		RenewDeadline:   s.LeaderElection.RenewDeadline,
+		RetryPeriod:     s.LeaderElection.RetryPeriod,
+		Name:            s.LeaderElection.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(lctx context.Context) {
+				s.Log.Infof("acquired leader lease '%v/%v' as '%v'", s.LeaderElection.Namespace, s.LeaderElection.Name, s.LeaderElection.Identity)
+				stop, cancel := either(ctx, lctx)
+				defer cancel()
+				e := s.runUntilShutdown(stop)
+				if e == nil && ctx.Err() == nil {
+					e = errLostLease
+				}
+				result <- e
+			},
+			OnStoppedLeading: func() {
+				s.Log.Infof("stopped leading '%v/%v'", s.LeaderElection.Namespace, s.LeaderElection.Name)
+			},
+		},
+	})
+	if e != nil {
+		return fmt.Errorf("unable to configure leader election, cause: %v", e)
+	}
+
+	//the elector gets its own context so the lease is only released after the daemon stopped.
+	lectx, release := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		le.Run(lectx)
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		if le.IsLeader() {
+			err = <-result
+		}
+	}
+	release()
+	<-stopped
+	return err
+}
+
+// runUntilShutdown bootstraps and runs the daemon. API calls use a work context that outlives stop by
+// ShutdownGrace, so a reconcile in flight is not cut off when the shutdown signal arrives.
+func (s *Server) runUntilShutdown(stop context.Context) error {
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	go func() {
+		select {
+		case <-stop.Done():
+			t := time.NewTimer(s.ShutdownGrace)
+			defer t.Stop()
+			select {
+			case <-t.C:
+				s.Log.Errorf("shutdown grace period of %v exceeded, aborting", s.ShutdownGrace)
+				cancelWork()
+			case <-work.Done():
+			}
+		case <-work.Done():
+		}
+	}()
+
+	if e := s.Bootstrap(work); e != nil {
+		return e
+	}
+	if e := s.daemon(stop, work); e != nil {
+		return e
+	}
+	s.Log.Info("shutdown complete")
+	return nil
+}
+
+// daemon reconciles all fleets whenever an ingress, ingressClass, service, secret or configMap in the cluster, or an
+// object the controller owns changes. Upgrades in progress are rechecked every progressPeriod, as validation jobs
+// and canary deployments are not watched. It fails only if the informer caches do not sync, without them there is
+// nothing to reconcile from.
+func (s *Server) daemon(stop context.Context, work context.Context) error {
+	changed := make(chan struct{}, 1)
+	if e := s.startInformers(work, changed); e != nil {
+		return e
+	}
+	defer func() { s.listers = nil }()
+	s.logObjects()
+	s.watchOwned(work, changed)
+	for {
+		if e := s.updateJ8aDeploymentWithFullClusterConfig(work); e != nil {
+			s.Log.Errorf("unable to reconcile j8a config, cause: %v", e)
+		}
+		var progress <-chan time.Time
+		if s.inProgress() {
+			progress = time.After(progressPeriod)
+		}
+		select {
+		case <-stop.Done():
+			return nil
+		case <-changed:
+		case <-progress:
+		}
+	}
+}
+
+// inProgress is true while a fleet rolls out config or an image, or validates an upgrade.
+func (s *Server) inProgress() bool {
+	for _, f := range s.Fleets {
+		target := f.imageRef()
+		if f.rollout != nil || f.canary != nil ||
+			(len(f.config) > 0 && target != f.image && !f.rejectedImages[f.upgradeKey(target)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// either returns a context that is done as soon as a or b is done.
+func either(a context.Context, b context.Context) (context.Context, context.CancelFunc) {
+	c, cancel := context.WithCancel(a)
+	go func() {
+		select {
+		case <-b.Done():
+			cancel()
+		case <-c.Done():
+		}
+	}()
+	return c, cancel
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunWithLeaderElectionReleasesLease(t *testing.T) {
+	s := NewServer()
+	c := newFakeClientset()
+	s.Kube.Client = c
+	s.LeaderElection.RetryPeriod = time.Millisecond * 100
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	//wait for the lease to be acquired
+	leases := c.CoordinationV1().Leases(s.LeaderElection.Namespace)
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		l, e := leases.Get(context.TODO(), s.LeaderElection.Name, metav1.GetOptions{})
+		if e == nil && l.Spec.HolderIdentity != nil && *l.Spec.HolderIdentity == s.LeaderElection.Identity {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	cancel()
+	select {
+	case e := <-done:
+		if e != nil {
+			t.Errorf("run should shut down cleanly, got %v", e)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("run did not shut down")
+	}
+
+	l, e := leases.Get(context.TODO(), s.LeaderElection.Name, metav1.GetOptions{})
+	if e != nil {
+		t.Fatalf("lease should exist, got %v", e)
+	}
+	if l.Spec.HolderIdentity != nil && len(*l.Spec.HolderIdentity) > 0 {
+		t.Errorf("lease should be released on shutdown, still held by %v", *l.Spec.HolderIdentity)
+	}
+}
+
+func TestRunUntilShutdownWithoutLeaderElection(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	s.Features.LeaderElection = false
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if e := s.Run(ctx); e != nil {
+		t.Errorf("run should shut down cleanly, got %v", e)
+	}
+}
+
+func TestDaemonFailsWithoutInformerCache(t *testing.T) {
+	s := NewServer()
+	c := newFakeClientset()
+	c.PrependReactor("list", "ingresses", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("forbidden")
+	})
+	s.Kube.Client = c
+
+	work, cancel := context.WithTimeout(context.TODO(), time.Millisecond*200)
+	defer cancel()
+	if e := s.daemon(context.TODO(), work); e == nil {
+		t.Errorf("daemon should fail if the informer cache does not sync")
+	}
+}
+
+func TestEither(t *testing.T) {
+	a, cancelA := context.WithCancel(context.TODO())
+	defer cancelA()
+	b, cancelB := context.WithCancel(context.TODO())
+
+	c, cancel := either(a, b)
+	defer cancel()
+	cancelB()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Errorf("context should be done when either parent is done")
+	}
+}
+
+func TestRejectedIngressEvent(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	fr := record.NewFakeRecorder(10)
+	s.Events.recorder = fr
+
+	il, _ := s.Kube.Client.NetworkingV1().Ingresses("").List(context.TODO(), metav1.ListOptions{})
+	il.Items = append(il.Items, *ingressFor("rejected", s.Fleets[0].IngressClass, netv1.ServiceBackendPort{Name: "http"}))
+	s.updateCacheFromIngressList(context.TODO(), il)
+
+	select {
+	case ev := <-fr.Events:
+		if !strings.HasPrefix(ev, "Warning Rejected") {
+			t.Errorf("want warning event for rejected ingress, got %v", ev)
+		}
+	default:
+		t.Errorf("want event for rejected ingress")
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+var (
+	readOnly  = []string{"get", "list", "watch"}
+	readWrite = []string{"get", "list", "watch", "create", "update", "patch"}
+)
+
+// Features are optional controller capabilities that need extra privileges.
+type Features struct {
+	Events           bool
+	LeaderElection   bool
+	ConfigFile       bool
+	ValidateUpgrades bool
+	NetworkPolicy    bool
+	ACME             bool
+}
+
+func DefaultFeatures() Features {
+	return Features{
+		Events:         true,
+		LeaderElection: true,
+	}
+}
+
+type Permission struct {
+	Group    string
+	Resource string
+	Verbs    []string
+}
+
+// Permissions is the least privilege set of verbs the controller needs for the enabled features. It is the single
+// source of truth for both the generated ClusterRole and the permission check during bootstrap.
+func (f Features) Permissions() []Permission {
+	p := []Permission{
+		{Group: "", Resource: "configmaps", Verbs: readOnly},
+		{Group: "", Resource: "secrets", Verbs: readOnly},
+		{Group: "", Resource: "services", Verbs: readWrite},
+		{Group: "", Resource: "pods", Verbs: readOnly},
+		{Group: "", Resource: "namespaces", Verbs: []string{"get", "create", "patch"}},
+		{Group: "apps", Resource: "deployments", Verbs: append(readWrite, "delete")},
+		{Group: "networking.k8s.io", Resource: "ingresses", Verbs: readOnly},
+		{Group: "networking.k8s.io", Resource: "ingressclasses", Verbs: readWrite},
+		{Group: "policy", Resource: "poddisruptionbudgets", Verbs: readWrite},
+		{Group: "autoscaling", Resource: "horizontalpodautoscalers", Verbs: append(readWrite, "delete")},
+	}
+	if f.Events {
+		p = append(p, Permission{Group: "", Resource: "events", Verbs: []string{"create", "patch"}})
+	}
+	if f.LeaderElection {
+		p = append(p, Permission{Group: "coordination.k8s.io", Resource: "leases", Verbs: []string{"get", "create", "update"}})
+	}
+	if f.ValidateUpgrades {
+		p = append(p, Permission{Group: "batch", Resource: "jobs", Verbs: []string{"get", "list", "create", "delete"}})
+		p = append(p, Permission{Group: "", Resource: "secrets", Verbs: []string{"create", "delete"}})
+	}
+	if f.NetworkPolicy {
+		p = append(p, Permission{Group: "networking.k8s.io", Resource: "networkpolicies", Verbs: readWrite})
+	}
+	if f.ACME {
+		p = append(p, Permission{Group: "", Resource: "secrets", Verbs: []string{"create", "update"}})
+	}
+	if f.ConfigFile {
+		p = append(p, Permission{Group: "", Resource: "configmaps", Verbs: []string{"create", "update", "patch"}})
+		p = append(p, Permission{Group: "", Resource: "secrets", Verbs: []string{"create", "update", "patch", "delete"}})
+	}
+	return p
+}
+
+// Install describes the bundle required to run the controller itself inside the cluster.
+type Install struct {
+	Namespace string
+	Image     string
+	Features  Features
+}
+
+const installName = "ingress-j8a"
+
+func NewInstall() *Install {
+	return &Install{
+		Namespace: "default",
+		Image:     "simonmittag/ingress-j8a:" + strings.TrimPrefix(Version, "v"),
+		Features:  DefaultFeatures(),
+	}
+}
+
+func (i *Install) Objects() []runtime.Object {
+	sa := &apiv1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "serviceaccount-" + installName,
+			Namespace: i.Namespace,
+		},
+	}
+
+	rules := make([]rbacv1.PolicyRule, 0)
+	for _, p := range i.Features.Permissions() {
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups: []string{p.Group},
+			Resources: []string{p.Resource},
+			Verbs:     p.Verbs,
+		})
+	}
+	cr := &rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: "clusterrole-" + installName},
+		Rules:      rules,
+	}
+
+	crb := &rbacv1.ClusterRoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: "clusterrolebinding-" + installName},
+		Subjects: []rbacv1.Subject{{
+			Kind:      "ServiceAccount",
+			Name:      sa.Name,
+			Namespace: i.Namespace,
+		}},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     cr.Name,
+		},
+	}
+
+	label := map[string]string{"app": installName}
+	d := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      installName,
+			Namespace: i.Namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32Ptr(1),
+			Selector: &metav1.LabelSelector{MatchLabels: label},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: label},
+				Spec: apiv1.PodSpec{
+					ServiceAccountName: sa.Name,
+					Containers: []apiv1.Container{{
+						Name:  installName,
+						Image: i.Image,
+						Ports: []apiv1.ContainerPort{{
+							Name:          "metrics",
+							Protocol:      apiv1.ProtocolTCP,
+							ContainerPort: 9090,
+						}},
+						Args: []string{
+							fmt.Sprintf("-events=%v", i.Features.Events),
+							fmt.Sprintf("-leader-elect=%v", i.Features.LeaderElection),
+							fmt.Sprintf("-j8a-config-file=%v", i.Features.ConfigFile),
+							fmt.Sprintf("-j8a-validate-upgrades=%v", i.Features.ValidateUpgrades),
+							fmt.Sprintf("-j8a-network-policy=%v", i.Features.NetworkPolicy),
+							fmt.Sprintf("-acme=%v", i.Features.ACME),
+						},
+						Env: []apiv1.EnvVar{{
+							Name: leaseNamespaceEnv,
+							ValueFrom: &apiv1.EnvVarSource{
+								FieldRef: &apiv1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+							},
+						}},
+					}},
+				},
+			},
+		},
+	}
+
+	if !i.Features.ACME {
+		return []runtime.Object{sa, cr, crb, d}
+	}
+
+	//j8a sends acme challenges to the solver of any controller replica through this service.
+	c := &d.Spec.Template.Spec.Containers[0]
+	c.Ports = append(c.Ports, apiv1.ContainerPort{Name: "acme", Protocol: apiv1.ProtocolTCP, ContainerPort: acmeSolverPort})
+	svc := &apiv1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      installName,
+			Namespace: i.Namespace,
+		},
+		Spec: apiv1.ServiceSpec{
+			Selector: label,
+			Ports: []apiv1.ServicePort{{
+				Name:       "acme",
+				Protocol:   apiv1.ProtocolTCP,
+				Port:       acmeSolverPort,
+				TargetPort: intstr.FromString("acme"),
+			}},
+		},
+	}
+	return []runtime.Object{sa, cr, crb, d, svc}
+}
+
+// YAML writes all objects of the install bundle as a multi document stream for kubectl apply -f.
+func (i *Install) YAML(w io.Writer) error {
+	for _, o := range i.Objects() {
+		b, e := yaml.Marshal(o)
+		if e != nil {
+			return e
+		}
+		if _, e = fmt.Fprintf(w, "---\n%s", b); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+)
+
+func hasPermission(ps []Permission, resource string) bool {
+	for _, p := range ps {
+		if p.Resource == resource {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFeaturePermissions(t *testing.T) {
+	all := DefaultFeatures().Permissions()
+	for _, r := range []string{"events", "ingressclasses", "deployments", "pods"} {
+		if !hasPermission(all, r) {
+			t.Errorf("default permissions should include %v", r)
+		}
+	}
+	for _, r := range []string{"replicasets", "ingresses/status"} {
+		if hasPermission(all, r) {
+			t.Errorf("permissions should not include unused resource %v", r)
+		}
+	}
+
+	if hasPermission(all, "networkpolicies") || !hasPermission(Features{NetworkPolicy: true}.Permissions(), "networkpolicies") {
+		t.Errorf("networkpolicies should only be required by the networkPolicy feature")
+	}
+
+	none := Features{}.Permissions()
+	if hasPermission(none, "events") {
+		t.Errorf("disabled features should not require privileges")
+	}
+}
+
+func allows(ps []Permission, resource string, verb string) bool {
+	for _, p := range ps {
+		if p.Resource != resource {
+			continue
+		}
+		for _, v := range p.Verbs {
+			if v == verb {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TestPermissionsCoverCalls runs bootstrap, a canary upgrade, autoscaling on and off and acme issuance with the
+// default and with every feature, and checks each call the controller made against the generated ClusterRole.
+func TestPermissionsCoverCalls(t *testing.T) {
+	for _, features := range []Features{
+		DefaultFeatures(),
+		{Events: true, LeaderElection: true, ConfigFile: true, ValidateUpgrades: true, NetworkPolicy: true, ACME: true},
+	} {
+		ps := features.Permissions()
+		for _, a := range controllerCalls(t, features) {
+			r := a.GetResource().Resource
+			//discovery and access reviews need no grant
+			switch r {
+			case "version", "group", "resource", "selfsubjectaccessreviews":
+				continue
+			}
+			if len(a.GetSubresource()) > 0 {
+				r = r + "/" + a.GetSubresource()
+			}
+			if !allows(ps, r, a.GetVerb()) {
+				t.Errorf("controller calls %v %v without permission with features %+v", a.GetVerb(), r, features)
+			}
+		}
+	}
+}
+
+func controllerCalls(t *testing.T, features Features) []k8stesting.Action {
+	s := NewServer()
+	s.Features = features
+	c := newFakeClientset()
+	s.Kube.Client = c
+	s.Events.recorder = record.NewFakeRecorder(10)
+	f := s.Fleets[0]
+	ctx := context.TODO()
+	//calls of the test itself, i.e. faking status, are dropped
+	var actions []k8stesting.Action
+	controller := func() {
+		actions = append(actions, c.Actions()...)
+		c.ClearActions()
+	}
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+	controller()
+	completeRollout(t, s, f)
+	c.ClearActions()
+	s.rolloutJ8aConfig(ctx, f)
+	controller()
+
+	f.Version = "v1.2.0"
+	f.Upgrade = &Upgrade{Canary: true}
+	s.rolloutJ8aConfig(ctx, f)
+	controller()
+	if features.ValidateUpgrades {
+		validateJob(t, s, f, batchv1.JobComplete)
+		c.ClearActions()
+		s.rolloutJ8aConfig(ctx, f)
+		controller()
+	}
+	completeDeployment(t, s, f.Namespace, f.canaryName())
+	c.ClearActions()
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should upgrade, got %v", e)
+	}
+	controller()
+	completeRollout(t, s, f)
+	c.ClearActions()
+	s.rolloutJ8aConfig(ctx, f)
+	controller()
+
+	s.Kube.Capabilities.AutoscalingV2 = true
+	f.Deployment.Autoscaling = &Autoscaling{MaxReplicas: 5}
+	s.reconcileJ8aScaling(ctx, f)
+	f.Deployment.Autoscaling = nil
+	s.reconcileJ8aScaling(ctx, f)
+	controller()
+
+	if features.ACME {
+		//issuing and renewing an acme certificate
+		s.acmeAccountKey(ctx, true)
+		s.storeAcmeCertificate(ctx, f, "chain", "key")
+		s.storeAcmeCertificate(ctx, f, "chain", "key")
+		controller()
+	}
+	return actions
+}
+
+func TestInstallYAML(t *testing.T) {
+	i := NewInstall()
+	i.Namespace = "ingress"
+
+	var b bytes.Buffer
+	if e := i.YAML(&b); e != nil {
+		t.Fatalf("should render manifests, got %v", e)
+	}
+
+	docs := strings.Split(b.String(), "---\n")[1:]
+	if len(docs) != 4 {
+		t.Fatalf("want 4 documents, got %v", len(docs))
+	}
+	for _, d := range docs {
+		m := make(map[string]interface{})
+		if e := yaml.Unmarshal([]byte(d), &m); e != nil {
+			t.Errorf("document should be valid yaml, got %v", e)
+		}
+		if _, ok := m["kind"]; !ok {
+			t.Errorf("document should have kind")
+		}
+	}
+	if !strings.Contains(b.String(), "namespace: ingress") {
+		t.Errorf("manifests should use configured namespace")
+	}
+
+	i.Features.ACME = true
+	objs := i.Objects()
+	svc, ok := objs[len(objs)-1].(*apiv1.Service)
+	if len(objs) != 5 || !ok || svc.Name != installName || svc.Spec.Ports[0].Port != acmeSolverPort {
+		t.Errorf("acme should add the solver service, got %v objects", len(objs))
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics holds gauges and counters of the controller, exposed in prometheus text format.
+type Metrics struct {
+	lock   sync.Mutex
+	series map[string]*metric
+}
+
+type metric struct {
+	help   string
+	kind   string
+	values map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{series: make(map[string]*metric)}
+}
+
+func (m *Metrics) get(name string, kind string, help string) *metric {
+	s, ok := m.series[name]
+	if !ok {
+		s = &metric{help: help, kind: kind, values: make(map[string]float64)}
+		m.series[name] = s
+	}
+	return s
+}
+
+// Set a gauge for one set of labels.
+func (m *Metrics) Set(name string, help string, labels map[string]string, v float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(name, "gauge", help).values[labelString(labels)] = v
+}
+
+// Inc a counter for one set of labels.
+func (m *Metrics) Inc(name string, help string, labels map[string]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(name, "counter", help).values[labelString(labels)]++
+}
+
+// Reset drops all series of name that carry the label, i.e. all hosts of one fleet before they are set again.
+func (m *Metrics) Reset(name string, label string, value string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s, ok := m.series[name]; ok {
+		match := fmt.Sprintf("%s=%q", label, value)
+		for l := range s.values {
+			for _, kv := range splitLabels(l) {
+				if kv == match {
+					delete(s.values, l)
+				}
+			}
+		}
+	}
+}
+
+// Get returns the value of a series, for tests and status.
+func (m *Metrics) Get(name string, labels map[string]string) (float64, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s, ok := m.series[name]; ok {
+		v, ok := s.values[labelString(labels)]
+		return v, ok
+	}
+	return 0, false
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var b strings.Builder
+	names := make([]string, 0, len(m.series))
+	for n := range m.series {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		s := m.series[n]
+		b.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", n, s.help, n, s.kind))
+		ls := make([]string, 0, len(s.values))
+		for l := range s.values {
+			ls = append(ls, l)
+		}
+		sort.Strings(ls)
+		for _, l := range ls {
+			b.WriteString(fmt.Sprintf("%s%s %v\n", n, l, s.values[l]))
+		}
+	}
+	i, e := io.WriteString(w, b.String())
+	return int64(i), e
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+func labelString(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kv := make([]string, 0, len(keys))
+	for _, k := range keys {
+		kv = append(kv, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return "{" + strings.Join(kv, ",") + "}"
+}
+
+func splitLabels(l string) []string {
+	return strings.Split(strings.TrimSuffix(strings.TrimPrefix(l, "{"), "}"), ",")
+}
+
+// serveMetrics exposes metrics until ctx is done, nothing happens without MetricsAddr.
+func (s *Server) serveMetrics(ctx context.Context) {
+	if len(s.MetricsAddr) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.Metrics)
+	hs := &http.Server{Addr: s.MetricsAddr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hs.Shutdown(sctx)
+	}()
+	go func() {
+		s.Log.Infof("serving metrics on %v/metrics", s.MetricsAddr)
+		if e := hs.ListenAndServe(); e != nil && e != http.ErrServerClosed {
+			s.Log.Errorf("unable to serve metrics, cause: %v", e)
+		}
+	}()
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// namespaceNameLabel is set on every namespace by kube apiserver since 1.21.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// reconcileJ8aNetworkPolicy applies the NetworkPolicy of the fleet if the feature is enabled. j8a pods accept traffic
+// on 80 and 443 only, and reach DNS and the pods of the services referenced by the routes in the cache, which include
+// the acme solver of the controller. Routes with a remote jwks url also reach the internet on their port.
+func (s *Server) reconcileJ8aNetworkPolicy(ctx context.Context, f *J8a) error {
+	if !s.Features.NetworkPolicy {
+		return nil
+	}
+	npClient := s.Kube.Client.NetworkingV1().NetworkPolicies(f.Namespace)
+	tcp := apiv1.ProtocolTCP
+	return s.reconcile(ctx, f, managed{
+		kind: "networkPolicy",
+		name: f.Deployment.Name,
+		want: &netv1.NetworkPolicy{
+			TypeMeta: metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      f.Deployment.Name,
+				Namespace: f.Namespace,
+			},
+			Spec: netv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: f.Pod.Label},
+				PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress, netv1.PolicyTypeEgress},
+				Ingress: []netv1.NetworkPolicyIngressRule{{
+					Ports: []netv1.NetworkPolicyPort{
+						{Protocol: &tcp, Port: intstrPtr(intstr.FromInt(80))},
+						{Protocol: &tcp, Port: intstrPtr(intstr.FromInt(443))},
+					},
+				}},
+				Egress: s.egressRules(ctx, f.routes()),
+			},
+		},
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return npClient.Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := npClient.Patch(ctx, f.Deployment.Name, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+}
+
+// egressRules allow DNS, one rule per upstream service and the internet ports of jwks. Rules are sorted so
+// an unchanged route table renders the same policy.
+func (s *Server) egressRules(ctx context.Context, routes []Route) []netv1.NetworkPolicyEgressRule {
+	tcp, udp := apiv1.ProtocolTCP, apiv1.ProtocolUDP
+	rules := []netv1.NetworkPolicyEgressRule{{
+		Ports: []netv1.NetworkPolicyPort{
+			{Protocol: &udp, Port: intstrPtr(intstr.FromInt(53))},
+			{Protocol: &tcp, Port: intstrPtr(intstr.FromInt(53))},
+		},
+	}}
+
+	upstreams := make(map[string]Upstream)
+	external := make(map[int]bool)
+	for _, r := range routes {
+		upstreams[r.Upstream.Host+":"+r.Upstream.Port] = r.Upstream
+		if r.JWT != nil && len(r.JWT.JwksURL) > 0 {
+			if p, ok := urlPort(r.JWT.JwksURL); ok {
+				external[p] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(upstreams))
+	for k := range upstreams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if r, ok := s.upstreamEgress(ctx, upstreams[k]); ok {
+			rules = append(rules, r)
+		}
+	}
+
+	ports := make([]int, 0, len(external))
+	for p := range external {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	for _, p := range ports {
+		rules = append(rules, netv1.NetworkPolicyEgressRule{
+			Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: intstrPtr(intstr.FromInt(p))}},
+		})
+	}
+	return rules
+}
+
+// upstreamEgress allows the pods behind the service of an upstream on its target port. Policies apply after the
+// service address is translated, so the service port itself is not what j8a connects to. Services without
+// selector are allowed to their whole namespace, ExternalName services cannot be expressed and are skipped.
+func (s *Server) upstreamEgress(ctx context.Context, u Upstream) (netv1.NetworkPolicyEgressRule, bool) {
+	tcp := apiv1.ProtocolTCP
+	parts := strings.SplitN(u.Host, ".", 3)
+	if len(parts) < 2 {
+		s.Log.Errorf("unable to allow egress to upstream '%v', not a service dns name", u.Host)
+		return netv1.NetworkPolicyEgressRule{}, false
+	}
+	name, namespace := parts[0], parts[1]
+	port, e := strconv.Atoi(u.Port)
+	if e != nil {
+		s.Log.Errorf("unable to allow egress to upstream '%v', invalid port '%v'", u.Host, u.Port)
+		return netv1.NetworkPolicyEgressRule{}, false
+	}
+	peer := netv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: namespace}},
+	}
+	target := intstr.FromInt(port)
+
+	svc, e := s.getService(ctx, namespace, name)
+	if e == nil {
+		if svc.Spec.Type == apiv1.ServiceTypeExternalName {
+			s.Log.Errorf("unable to allow egress to upstream '%v', service is of type ExternalName", u.Host)
+			return netv1.NetworkPolicyEgressRule{}, false
+		}
+		if len(svc.Spec.Selector) > 0 {
+			peer.PodSelector = &metav1.LabelSelector{MatchLabels: svc.Spec.Selector}
+		}
+		for _, sp := range svc.Spec.Ports {
+			if int(sp.Port) == port && (sp.TargetPort != intstr.IntOrString{}) {
+				target = sp.TargetPort
+			}
+		}
+	} else {
+		s.Log.Errorf("unable to fetch service of upstream '%v', allowing its namespace on port %v, cause: %v", u.Host, port, e)
+	}
+
+	return netv1.NetworkPolicyEgressRule{
+		To:    []netv1.NetworkPolicyPeer{peer},
+		Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: &target}},
+	}, true
+}
+
+// urlPort is the port of a remote url, the default port of its scheme if none is given.
+func urlPort(raw string) (int, bool) {
+	u, e := url.Parse(raw)
+	if e != nil {
+		return 0, false
+	}
+	if p := u.Port(); len(p) > 0 {
+		n, e := strconv.Atoi(p)
+		return n, e == nil
+	}
+	switch u.Scheme {
+	case "https":
+		return 443, true
+	case "http":
+		return 80, true
+	}
+	return 0, false
+}
+
+func intstrPtr(i intstr.IntOrString) *intstr.IntOrString {
+	return &i
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"testing"
+)
+
+func TestNetworkPolicyFollowsRoutes(t *testing.T) {
+	s := NewServer()
+	s.Features.NetworkPolicy = true
+	f := s.Fleets[0]
+	c := newFakeClientset()
+	c.Tracker().Add(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "s1", Namespace: "default"},
+		Spec: apiv1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports:    []apiv1.ServicePort{{Port: 80, TargetPort: intstr.FromString("http")}},
+		},
+	})
+	c.Tracker().Add(ingressFor("web", f.IngressClass, netv1.ServiceBackendPort{Number: 80}))
+	s.Kube.Client = c
+	ctx := context.TODO()
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+
+	np, e := s.Kube.Client.NetworkingV1().NetworkPolicies(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if e != nil {
+		t.Fatalf("should create networkPolicy, got %v", e)
+	}
+	if np.Spec.PodSelector.MatchLabels["app"] != f.Pod.Label["app"] || len(np.Spec.PolicyTypes) != 2 {
+		t.Errorf("networkPolicy should select j8a pods in both directions, got %+v", np.Spec)
+	}
+	if len(np.Spec.Ingress) != 1 || len(np.Spec.Ingress[0].Ports) != 2 || np.Spec.Ingress[0].Ports[1].Port.IntVal != 443 {
+		t.Errorf("networkPolicy should only admit 80 and 443, got %+v", np.Spec.Ingress)
+	}
+	if len(np.Spec.Egress) != 2 || np.Spec.Egress[0].Ports[0].Port.IntVal != 53 {
+		t.Fatalf("networkPolicy should allow dns and the routed service, got %+v", np.Spec.Egress)
+	}
+	to := np.Spec.Egress[1]
+	if to.To[0].NamespaceSelector.MatchLabels[namespaceNameLabel] != "default" || to.To[0].PodSelector.MatchLabels["app"] != "web" {
+		t.Errorf("egress should select the pods of the service, got %+v", to.To)
+	}
+	if to.Ports[0].Port.StrVal != "http" {
+		t.Errorf("egress should allow the target port of the service, got %+v", to.Ports)
+	}
+
+	s.Kube.Client.NetworkingV1().Ingresses("default").Delete(ctx, "web", metav1.DeleteOptions{})
+	if e := s.updateJ8aDeploymentWithFullClusterConfig(ctx); e != nil {
+		t.Fatalf("should reconcile, got %v", e)
+	}
+	np, _ = s.Kube.Client.NetworkingV1().NetworkPolicies(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if len(np.Spec.Egress) != 1 {
+		t.Errorf("egress should shrink to dns without routes, got %+v", np.Spec.Egress)
+	}
+}
+
+func TestNetworkPolicyDisabled(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	ctx := context.TODO()
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+	if _, e := s.Kube.Client.NetworkingV1().NetworkPolicies(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{}); e == nil {
+		t.Errorf("should not create networkPolicy unless enabled")
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	s.Kube.Client.CoreV1().Services("ext").Create(context.TODO(), &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "ext"},
+		Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeExternalName, ExternalName: "legacy.example.com"},
+	}, metav1.CreateOptions{})
+
+	routes := []Route{
+		*NewRoute().WithUpstream("legacy.ext.svc.cluster.local", "80"),
+		*NewRoute().WithUpstream("missing.team.svc.cluster.local", "8080"),
+		{Upstream: Upstream{Host: "missing.team.svc.cluster.local", Port: "8080"}, ACME: true},
+		{Upstream: Upstream{Host: "missing.team.svc.cluster.local", Port: "8080"}, JWT: &JWT{JwksURL: "https://idp.example.com:8443/jwks"}},
+	}
+	rules := s.egressRules(context.TODO(), routes)
+	if len(rules) != 3 {
+		t.Fatalf("want dns, one service and the jwks port, got %+v", rules)
+	}
+	if rules[1].To[0].PodSelector != nil || rules[1].Ports[0].Port.IntVal != 8080 {
+		t.Errorf("unknown service should allow its namespace on the service port, got %+v", rules[1])
+	}
+	if len(rules[2].To) != 0 || rules[2].Ports[0].Port.IntVal != 8443 {
+		t.Errorf("jwks should reach the internet on its port, acme is solved by the controller, got %+v", rules[2])
+	}
+}
+
+func TestUrlPort(t *testing.T) {
+	for raw, want := range map[string]int{"https://a.example.com/jwks": 443, "http://a.example.com": 80, "https://a:9443/": 9443} {
+		if got, ok := urlPort(raw); !ok || got != want {
+			t.Errorf("%v want port %v, got %v", raw, want, got)
+		}
+	}
+	if _, ok := urlPort("a.example.com"); ok {
+		t.Errorf("should not guess port without scheme")
+	}
+}
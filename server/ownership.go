@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	ManagedByLabel              = "app.kubernetes.io/managed-by"
+	NameLabel                   = "app.kubernetes.io/name"
+	InstanceLabel               = "app.kubernetes.io/instance"
+	ControllerVersionAnnotation = annotationPrefix + "controller-version"
+	FleetAnnotation             = annotationPrefix + "fleet"
+	managedBy                   = "ingress-j8a"
+)
+
+// ownership is the metadata stamped on every object of a fleet. Objects shared by fleets, such as their namespace,
+// only name the controller.
+func (s *Server) ownership(f *J8a, shared bool) (map[string]string, map[string]string) {
+	labels := map[string]string{
+		ManagedByLabel: managedBy,
+		NameLabel:      "j8a",
+	}
+	annotations := map[string]string{
+		ControllerVersionAnnotation: s.Version,
+	}
+	if !shared {
+		labels[InstanceLabel] = f.String()
+		annotations[FleetAnnotation] = f.String()
+	}
+	return labels, annotations
+}
+
+// stamp adds the ownership metadata to obj.
+func (s *Server) stamp(obj runtime.Object, f *J8a, shared bool) {
+	m, e := meta.Accessor(obj)
+	if e != nil {
+		return
+	}
+	labels, annotations := s.ownership(f, shared)
+	m.SetLabels(mergeMaps(m.GetLabels(), labels))
+	m.SetAnnotations(mergeMaps(m.GetAnnotations(), annotations))
+}
+
+// owns is true if obj carries the ownership labels of the fleet. Legacy objects without managed-by label are owned if
+// the controller's field manager applied them before, i.e. a previous release did.
+func owns(obj runtime.Object, f *J8a, shared bool) bool {
+	m, e := meta.Accessor(obj)
+	if e != nil {
+		return false
+	}
+	l := m.GetLabels()
+	if o, ok := l[ManagedByLabel]; ok {
+		return o == managedBy && (shared || l[InstanceLabel] == f.String())
+	}
+	for _, mf := range m.GetManagedFields() {
+		if mf.Manager == FieldManager {
+			return true
+		}
+	}
+	return false
+}
+
+// mayDelete refuses to delete live objects the fleet does not own, unless it adopts them.
+func (s *Server) mayDelete(kind string, name string, live runtime.Object, f *J8a) error {
+	if f.Adopt || owns(live, f, false) {
+		return nil
+	}
+	e := conflict(kind, name, live, f)
+	s.event(live, apiv1.EventTypeWarning, "OwnershipConflict", "%v", e)
+	return e
+}
+
+// conflict explains why an object is not taken over.
+func conflict(kind string, name string, obj runtime.Object, f *J8a) error {
+	owner := "nobody"
+	if m, e := meta.Accessor(obj); e == nil {
+		if o, ok := m.GetLabels()[ManagedByLabel]; ok {
+			owner = fmt.Sprintf("'%v' instance '%v'", o, m.GetLabels()[InstanceLabel])
+		}
+	}
+	return fmt.Errorf("%v '%v' exists and is managed by %v, not fleet '%v'. set adopt to take it over", kind, name, owner, f)
+}
+
+func mergeMaps(dst map[string]string, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = make(map[string]string)
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+)
+
+func TestBootstrapStampsOwnership(t *testing.T) {
+	s := NewServer()
+	s.Version = "v1.0.0"
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	ctx := context.TODO()
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+
+	d, _ := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	svc, _ := s.Kube.Client.CoreV1().Services(f.Namespace).Get(ctx, f.Service, metav1.GetOptions{})
+	ic, _ := s.Kube.Client.NetworkingV1().IngressClasses().Get(ctx, f.IngressClass, metav1.GetOptions{})
+	for _, m := range []metav1.ObjectMeta{d.ObjectMeta, svc.ObjectMeta, ic.ObjectMeta} {
+		if m.Labels[ManagedByLabel] != managedBy || m.Labels[InstanceLabel] != f.String() {
+			t.Errorf("%v should carry ownership labels, got %v", m.Name, m.Labels)
+		}
+		if m.Annotations[ControllerVersionAnnotation] != "v1.0.0" || m.Annotations[FleetAnnotation] != f.String() {
+			t.Errorf("%v should carry ownership annotations, got %v", m.Name, m.Annotations)
+		}
+	}
+
+	ns, _ := s.Kube.Client.CoreV1().Namespaces().Get(ctx, f.Namespace, metav1.GetOptions{})
+	if ns.Labels[ManagedByLabel] != managedBy {
+		t.Errorf("namespace should be managed by the controller, got %v", ns.Labels)
+	}
+	if _, ok := ns.Labels[InstanceLabel]; ok {
+		t.Errorf("shared namespace should not name a fleet, got %v", ns.Labels)
+	}
+}
+
+func TestBootstrapRefusesForeignObject(t *testing.T) {
+	s := NewServer()
+	f := s.Fleets[0]
+	foreign := &apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: f.Service, Namespace: f.Namespace,
+		Labels: map[string]string{ManagedByLabel: "helm"}}}
+	c := newFakeClientset()
+	c.Tracker().Add(foreign)
+	s.Kube.Client = c
+	fr := record.NewFakeRecorder(10)
+	s.Events.recorder = fr
+	ctx := context.TODO()
+
+	e := s.Bootstrap(ctx)
+	var be *BootstrapError
+	if !errors.As(e, &be) || be.Phase != PhaseService {
+		t.Fatalf("want bootstrap error in phase %v, got %v", PhaseService, e)
+	}
+	svc, _ := s.Kube.Client.CoreV1().Services(f.Namespace).Get(ctx, f.Service, metav1.GetOptions{})
+	if svc.Labels[ManagedByLabel] != "helm" {
+		t.Errorf("should not take over foreign service, got %v", svc.Labels)
+	}
+	if ev := <-fr.Events; !strings.Contains(ev, "OwnershipConflict") {
+		t.Errorf("should record event, got %v", ev)
+	}
+
+	f.Adopt = true
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should adopt foreign service, got %v", e)
+	}
+	svc, _ = s.Kube.Client.CoreV1().Services(f.Namespace).Get(ctx, f.Service, metav1.GetOptions{})
+	if svc.Labels[ManagedByLabel] != managedBy || svc.Labels[InstanceLabel] != f.String() {
+		t.Errorf("adopted service should carry ownership labels, got %v", svc.Labels)
+	}
+}
+
+func TestOwns(t *testing.T) {
+	s := NewServer()
+	f := s.Fleets[0]
+	other := &J8a{Name: "other"}
+
+	svc := &apiv1.Service{}
+	s.stamp(svc, f, false)
+	if !owns(svc, f, false) || owns(svc, other, false) {
+		t.Errorf("stamped object should be owned by its fleet only")
+	}
+	ns := &apiv1.Namespace{}
+	s.stamp(ns, f, true)
+	if !owns(ns, other, true) {
+		t.Errorf("shared object should be owned by every fleet")
+	}
+	applied := &apiv1.Service{ObjectMeta: metav1.ObjectMeta{ManagedFields: []metav1.ManagedFieldsEntry{{Manager: FieldManager}}}}
+	if !owns(applied, f, false) {
+		t.Errorf("legacy object applied by the controller should be owned")
+	}
+	applied.Labels = map[string]string{ManagedByLabel: "helm"}
+	if owns(applied, f, false) {
+		t.Errorf("object labelled by another manager should not be owned, whoever applied fields")
+	}
+	s.stamp(applied, other, false)
+	if owns(applied, f, false) {
+		t.Errorf("object of another fleet should not be owned, whoever applied fields")
+	}
+	if owns(&apiv1.Service{}, f, false) {
+		t.Errorf("unlabelled object should not be owned")
+	}
+}
+
+func TestDeleteOnlyOwned(t *testing.T) {
+	s, f := bootstrapUpgrade(t)
+	fr := record.NewFakeRecorder(10)
+	s.Events.recorder = fr
+	ctx := context.TODO()
+	foreign := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: f.canaryName(), Namespace: f.Namespace,
+		Labels: map[string]string{ManagedByLabel: "helm"}}}
+	s.Kube.Client.AppsV1().Deployments(f.Namespace).Create(ctx, foreign, metav1.CreateOptions{})
+	s.Kube.Client.AutoscalingV2().HorizontalPodAutoscalers(f.Namespace).Create(ctx, &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: foreign.ObjectMeta}, metav1.CreateOptions{})
+
+	if e := s.deleteJ8aCanary(ctx, f); e == nil {
+		t.Errorf("should not delete foreign deployment named like the canary")
+	}
+	if _, e := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.canaryName(), metav1.GetOptions{}); e != nil {
+		t.Errorf("foreign deployment should survive, got %v", e)
+	}
+	if ev := <-fr.Events; !strings.Contains(ev, "OwnershipConflict") {
+		t.Errorf("should record event, got %v", ev)
+	}
+
+	f.Deployment.Name = f.canaryName()
+	if e := s.deleteJ8aAutoscaler(ctx, f); e == nil {
+		t.Errorf("should not delete foreign autoscaler")
+	}
+	f.Adopt = true
+	if e := s.deleteJ8aAutoscaler(ctx, f); e != nil {
+		t.Errorf("should delete adopted autoscaler, got %v", e)
+	}
+}
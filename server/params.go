@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"sort"
+	"strconv"
+)
+
+// Params are fleet wide j8a settings the ingress resource cannot express. They are read from the ConfigMap
+// referenced by spec.parameters of the fleet's ingressClass and override the defaults of configtemplate.yml.
+type Params struct {
+	DownstreamReadTimeoutSeconds      int
+	DownstreamRoundTripTimeoutSeconds int
+	DownstreamIdleTimeoutSeconds      int
+	MaxBodyBytes                      int64
+	UpstreamSocketTimeoutSeconds      int
+	UpstreamReadTimeoutSeconds        int
+	UpstreamIdleTimeoutSeconds        int
+	UpstreamTLSInsecureSkipVerify     bool
+	HTTP2                             bool
+	AccessLog                         bool
+}
+
+// ParametersRef points the ingressClass of a fleet to a ConfigMap with Params. Namespace defaults to the
+// namespace of the fleet.
+type ParametersRef struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+func DefaultParams() Params {
+	return Params{
+		DownstreamReadTimeoutSeconds:      5,
+		DownstreamRoundTripTimeoutSeconds: 120,
+		DownstreamIdleTimeoutSeconds:      30,
+		MaxBodyBytes:                      1048576,
+		UpstreamSocketTimeoutSeconds:      3,
+		UpstreamReadTimeoutSeconds:        120,
+		UpstreamIdleTimeoutSeconds:        10,
+		UpstreamTLSInsecureSkipVerify:     true,
+		HTTP2:                             true,
+		AccessLog:                         true,
+	}
+}
+
+// ParseParams reads ConfigMap data on top of the defaults. Unknown keys are rejected so typos don't go unnoticed.
+func ParseParams(data map[string]string) (Params, error) {
+	p := DefaultParams()
+	ints := map[string]*int{
+		"downstreamReadTimeoutSeconds":      &p.DownstreamReadTimeoutSeconds,
+		"downstreamRoundTripTimeoutSeconds": &p.DownstreamRoundTripTimeoutSeconds,
+		"downstreamIdleTimeoutSeconds":      &p.DownstreamIdleTimeoutSeconds,
+		"upstreamSocketTimeoutSeconds":      &p.UpstreamSocketTimeoutSeconds,
+		"upstreamReadTimeoutSeconds":        &p.UpstreamReadTimeoutSeconds,
+		"upstreamIdleTimeoutSeconds":        &p.UpstreamIdleTimeoutSeconds,
+	}
+	bools := map[string]*bool{
+		"upstreamTlsInsecureSkipVerify": &p.UpstreamTLSInsecureSkipVerify,
+		"http2":                         &p.HTTP2,
+		"accessLog":                     &p.AccessLog,
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := data[k]
+		if ip, ok := ints[k]; ok {
+			i, e := strconv.Atoi(v)
+			if e != nil || i <= 0 {
+				return p, fmt.Errorf("unable to parse parameter '%v', want positive seconds, got '%v'", k, v)
+			}
+			*ip = i
+		} else if bp, ok := bools[k]; ok {
+			b, e := strconv.ParseBool(v)
+			if e != nil {
+				return p, fmt.Errorf("unable to parse parameter '%v', want true or false, got '%v'", k, v)
+			}
+			*bp = b
+		} else if k == "maxBodyBytes" {
+			i, e := strconv.ParseInt(v, 10, 64)
+			if e != nil || i <= 0 {
+				return p, fmt.Errorf("unable to parse parameter '%v', want positive bytes, got '%v'", k, v)
+			}
+			p.MaxBodyBytes = i
+		} else {
+			return p, fmt.Errorf("unknown parameter '%v'", k)
+		}
+	}
+	return p, nil
+}
+
+// ingressClassParameters builds spec.parameters for the ingressClass of the fleet, nil if none are configured.
+func (s *Server) ingressClassParameters(f *J8a) *netv1.IngressClassParametersReference {
+	if f.Parameters == nil {
+		return nil
+	}
+	r := &netv1.IngressClassParametersReference{
+		Kind: "ConfigMap",
+		Name: f.Parameters.Name,
+	}
+	//scope and namespace went GA together, older clusters only know cluster scoped parameters.
+	if s.Kube.Capabilities.IngressClassParams {
+		scope := "Namespace"
+		ns := f.Namespace
+		if len(f.Parameters.Namespace) > 0 {
+			ns = f.Parameters.Namespace
+		}
+		r.Scope = &scope
+		r.Namespace = &ns
+	}
+	return r
+}
+
+// fetchParams follows spec.parameters of the live ingressClass, users may point it elsewhere after we created it.
+// Without parameters the fleet runs on defaults.
+func (s *Server) fetchParams(ctx context.Context, f *J8a) (Params, error) {
+	ic, e := s.getIngressClass(ctx, f.IngressClass)
+	if e != nil {
+		return f.params, fmt.Errorf("unable to fetch ingressClass '%v', cause: %v", f.IngressClass, e)
+	}
+	pr := ic.Spec.Parameters
+	if pr == nil {
+		return DefaultParams(), nil
+	}
+	if (pr.APIGroup != nil && len(*pr.APIGroup) > 0) || pr.Kind != "ConfigMap" {
+		return f.params, fmt.Errorf("unsupported parameters kind '%v' for ingressClass '%v', want ConfigMap", pr.Kind, f.IngressClass)
+	}
+	ns := f.Namespace
+	if pr.Namespace != nil && len(*pr.Namespace) > 0 {
+		ns = *pr.Namespace
+	}
+	cm, e := s.getConfigMap(ctx, ns, pr.Name)
+	if e != nil {
+		return f.params, fmt.Errorf("unable to fetch parameters configMap '%v/%v', cause: %v", ns, pr.Name, e)
+	}
+	p, e := ParseParams(cm.Data)
+	if e != nil {
+		return f.params, fmt.Errorf("invalid parameters configMap '%v/%v', cause: %v", ns, pr.Name, e)
+	}
+	return p, nil
+}
+
+// updateParams keeps the last valid params of the fleet if the ConfigMap is broken, so a typo does not roll out.
+func (s *Server) updateParams(ctx context.Context, f *J8a) {
+	p, e := s.fetchParams(ctx, f)
+	if e != nil {
+		s.Log.Errorf("keeping previous parameters for fleet '%v', cause: %v", f, e)
+		if ic, ge := s.getIngressClass(ctx, f.IngressClass); ge == nil {
+			s.event(ic, apiv1.EventTypeWarning, "InvalidParameters", "%v", e)
+		}
+		return
+	}
+	if p != f.params {
+		s.Log.Infof("parameters for fleet '%v' changed to %+v", f, p)
+	}
+	f.params = p
+}
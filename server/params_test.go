@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+func TestParseParams(t *testing.T) {
+	p, e := ParseParams(map[string]string{
+		"downstreamReadTimeoutSeconds": "10",
+		"maxBodyBytes":                 "2097152",
+		"http2":                        "false",
+	})
+	if e != nil {
+		t.Fatalf("should parse params, got %v", e)
+	}
+	if p.DownstreamReadTimeoutSeconds != 10 || p.MaxBodyBytes != 2097152 || p.HTTP2 {
+		t.Errorf("params not parsed, got %+v", p)
+	}
+	if p.UpstreamReadTimeoutSeconds != DefaultParams().UpstreamReadTimeoutSeconds {
+		t.Errorf("missing params should keep defaults, got %+v", p)
+	}
+
+	for _, bad := range []map[string]string{
+		{"downstreamReadTimeoutSeconds": "-1"},
+		{"maxBodyBytes": "lots"},
+		{"accessLog": "maybe"},
+		{"readTimeout": "5"},
+	} {
+		if _, e := ParseParams(bad); e == nil {
+			t.Errorf("should reject params %v", bad)
+		}
+	}
+}
+
+func TestFetchParams(t *testing.T) {
+	s := NewServer()
+	f := s.Fleets[0]
+	s.Kube.Client = fake.NewSimpleClientset(
+		&netv1.IngressClass{
+			ObjectMeta: metav1.ObjectMeta{Name: f.IngressClass},
+			Spec: netv1.IngressClassSpec{Parameters: &netv1.IngressClassParametersReference{
+				Kind: "ConfigMap",
+				Name: "j8a-params",
+			}},
+		},
+		&apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "j8a-params", Namespace: f.Namespace},
+			Data:       map[string]string{"upstreamReadTimeoutSeconds": "30"},
+		},
+	)
+
+	s.updateParams(context.TODO(), f)
+	if f.params.UpstreamReadTimeoutSeconds != 30 {
+		t.Errorf("want params from configMap, got %+v", f.params)
+	}
+
+	cm, _ := s.Kube.Client.CoreV1().ConfigMaps(f.Namespace).Get(context.TODO(), "j8a-params", metav1.GetOptions{})
+	cm.Data["upstreamReadTimeoutSeconds"] = "soon"
+	s.Kube.Client.CoreV1().ConfigMaps(f.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	s.updateParams(context.TODO(), f)
+	if f.params.UpstreamReadTimeoutSeconds != 30 {
+		t.Errorf("invalid configMap should keep previous params, got %+v", f.params)
+	}
+}
+
+func TestRenderJ8aConfig(t *testing.T) {
+	f := NewJ8a("")
+	f.params.DownstreamRoundTripTimeoutSeconds = 60
+	f.Cache.update([]Route{
+		*NewRouteFrom("/a", "a.example.com", nil, "").WithUpstream("s1.default.svc.cluster.local", "80"),
+		*NewRouteFrom("/b", "", nil, "").WithUpstream("s1.default.svc.cluster.local", "80"),
+	})
+
+	c, e := renderJ8aConfig(f, "")
+	if e != nil {
+		t.Fatalf("should render config, got %v", e)
+	}
+	m := make(map[string]interface{})
+	if e := yaml.Unmarshal([]byte(c), &m); e != nil {
+		t.Fatalf("rendered config should be yaml, got %v\n%v", e, c)
+	}
+	if len(m["routes"].([]interface{})) != 2 {
+		t.Errorf("want 2 routes, got %v", m["routes"])
+	}
+	if len(m["resources"].(map[string]interface{})) != 1 {
+		t.Errorf("routes to the same service port should share a resource, got %v", m["resources"])
+	}
+	if !strings.Contains(c, "roundTripTimeoutSeconds: 60") || !strings.Contains(c, "host: a.example.com") {
+		t.Errorf("config should contain params and route host, got\n%v", c)
+	}
+}
+
+func TestRolloutJ8aConfig(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	if e := s.Bootstrap(context.TODO()); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+	hash := func() string {
+		d, _ := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(context.TODO(), f.Deployment.Name, metav1.GetOptions{})
+		return d.Spec.Template.Annotations[ConfigHashAnnotation]
+	}
+	before := hash()
+
+	f.params.MaxBodyBytes = 1024
+	if e := s.rolloutJ8aConfig(context.TODO(), f); e != nil {
+		t.Fatalf("should roll out config, got %v", e)
+	}
+	if hash() == before {
+		t.Errorf("changed params should roll out a new config hash")
+	}
+}
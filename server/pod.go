@@ -0,0 +1,159 @@
+package server
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Pod configures the j8a pods of a fleet. Settings left empty get production defaults, see podSpec.
+type Pod struct {
+	Name                          string                           `json:"name,omitempty"`
+	Label                         map[string]string                `json:"label,omitempty"`
+	Resources                     *apiv1.ResourceRequirements      `json:"resources,omitempty"`
+	ReadinessProbe                *apiv1.Probe                     `json:"readinessProbe,omitempty"`
+	LivenessProbe                 *apiv1.Probe                     `json:"livenessProbe,omitempty"`
+	SecurityContext               *apiv1.SecurityContext           `json:"securityContext,omitempty"`
+	PodSecurityContext            *apiv1.PodSecurityContext        `json:"podSecurityContext,omitempty"`
+	TerminationGracePeriodSeconds *int64                           `json:"terminationGracePeriodSeconds,omitempty"`
+	TopologySpreadConstraints     []apiv1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	Affinity                      *apiv1.Affinity                  `json:"affinity,omitempty"`
+}
+
+// defaultTerminationGracePeriodSeconds leaves j8a time to drain keep-alive connections after the pod left the
+// service endpoints.
+const defaultTerminationGracePeriodSeconds = 60
+
+func (p *Pod) merge(o Pod) {
+	mergeString(&p.Name, o.Name)
+	if len(o.Label) > 0 {
+		p.Label = o.Label
+	}
+	if o.Resources != nil {
+		p.Resources = o.Resources
+	}
+	if o.ReadinessProbe != nil {
+		p.ReadinessProbe = o.ReadinessProbe
+	}
+	if o.LivenessProbe != nil {
+		p.LivenessProbe = o.LivenessProbe
+	}
+	if o.SecurityContext != nil {
+		p.SecurityContext = o.SecurityContext
+	}
+	if o.PodSecurityContext != nil {
+		p.PodSecurityContext = o.PodSecurityContext
+	}
+	if o.TerminationGracePeriodSeconds != nil {
+		p.TerminationGracePeriodSeconds = o.TerminationGracePeriodSeconds
+	}
+	if o.TopologySpreadConstraints != nil {
+		p.TopologySpreadConstraints = o.TopologySpreadConstraints
+	}
+	if o.Affinity != nil {
+		p.Affinity = o.Affinity
+	}
+}
+
+// podSpec is the spec of the j8a pods with defaults for everything not configured: tcp probes on the http port,
+// non root with a read only root filesystem, spread across zones and nodes.
+func (p Pod) podSpec(container apiv1.Container) apiv1.PodSpec {
+	container.Resources = orDefaultResources(p.Resources)
+	container.ReadinessProbe = orDefaultProbe(p.ReadinessProbe, 5)
+	container.LivenessProbe = orDefaultProbe(p.LivenessProbe, 10)
+	container.SecurityContext = p.SecurityContext
+	if container.SecurityContext == nil {
+		container.SecurityContext = &apiv1.SecurityContext{
+			AllowPrivilegeEscalation: boolPtr(false),
+			ReadOnlyRootFilesystem:   boolPtr(true),
+			Capabilities: &apiv1.Capabilities{
+				Drop: []apiv1.Capability{"ALL"},
+			},
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{Name: "tmp", MountPath: "/tmp"})
+
+	spec := apiv1.PodSpec{
+		Containers:                    []apiv1.Container{container},
+		SecurityContext:               p.PodSecurityContext,
+		TerminationGracePeriodSeconds: p.TerminationGracePeriodSeconds,
+		TopologySpreadConstraints:     p.TopologySpreadConstraints,
+		Affinity:                      p.Affinity,
+		Volumes: []apiv1.Volume{{
+			Name:         "tmp",
+			VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}},
+		}},
+	}
+	if spec.SecurityContext == nil {
+		//non root binds 80 and 443 with the unprivileged port range opened, a safe sysctl since kube 1.22.
+		spec.SecurityContext = &apiv1.PodSecurityContext{
+			RunAsNonRoot: boolPtr(true),
+			RunAsUser:    int64Ptr(65534),
+			RunAsGroup:   int64Ptr(65534),
+			Sysctls: []apiv1.Sysctl{
+				{Name: "net.ipv4.ip_unprivileged_port_start", Value: "0"},
+			},
+			SeccompProfile: &apiv1.SeccompProfile{Type: apiv1.SeccompProfileTypeRuntimeDefault},
+		}
+	}
+	if spec.TerminationGracePeriodSeconds == nil {
+		spec.TerminationGracePeriodSeconds = int64Ptr(defaultTerminationGracePeriodSeconds)
+	}
+	selector := &metav1.LabelSelector{MatchLabels: p.Label}
+	if spec.TopologySpreadConstraints == nil {
+		for _, key := range []string{"topology.kubernetes.io/zone", "kubernetes.io/hostname"} {
+			spec.TopologySpreadConstraints = append(spec.TopologySpreadConstraints, apiv1.TopologySpreadConstraint{
+				MaxSkew:           1,
+				TopologyKey:       key,
+				WhenUnsatisfiable: apiv1.ScheduleAnyway,
+				LabelSelector:     selector,
+			})
+		}
+	}
+	if spec.Affinity == nil {
+		spec.Affinity = &apiv1.Affinity{
+			PodAntiAffinity: &apiv1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []apiv1.WeightedPodAffinityTerm{{
+					Weight: 100,
+					PodAffinityTerm: apiv1.PodAffinityTerm{
+						LabelSelector: selector,
+						TopologyKey:   "kubernetes.io/hostname",
+					},
+				}},
+			},
+		}
+	}
+	return spec
+}
+
+func orDefaultResources(r *apiv1.ResourceRequirements) apiv1.ResourceRequirements {
+	if r != nil {
+		return *r
+	}
+	//no cpu limit, throttling a proxy adds latency to every request.
+	return apiv1.ResourceRequirements{
+		Requests: apiv1.ResourceList{
+			apiv1.ResourceCPU:    resource.MustParse("100m"),
+			apiv1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+		Limits: apiv1.ResourceList{
+			apiv1.ResourceMemory: resource.MustParse("256Mi"),
+		},
+	}
+}
+
+func orDefaultProbe(p *apiv1.Probe, periodSeconds int32) *apiv1.Probe {
+	if p != nil {
+		return p
+	}
+	return &apiv1.Probe{
+		ProbeHandler: apiv1.ProbeHandler{
+			TCPSocket: &apiv1.TCPSocketAction{Port: intstr.FromString("http")},
+		},
+		PeriodSeconds:    periodSeconds,
+		FailureThreshold: 3,
+	}
+}
+
+func int64Ptr(i int64) *int64 { return &i }
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPodSpecDefaults(t *testing.T) {
+	f := NewJ8a("")
+	spec := f.desiredDeployment(getInitialJ8aConfig()).Spec.Template.Spec
+	c := spec.Containers[0]
+
+	if c.ReadinessProbe == nil || c.LivenessProbe == nil || c.ReadinessProbe.TCPSocket.Port.StrVal != "http" {
+		t.Errorf("should probe the http port, got %+v %+v", c.ReadinessProbe, c.LivenessProbe)
+	}
+	if c.Resources.Requests.Cpu().IsZero() || c.Resources.Limits.Memory().IsZero() {
+		t.Errorf("should request resources, got %+v", c.Resources)
+	}
+	if !*c.SecurityContext.ReadOnlyRootFilesystem || !*spec.SecurityContext.RunAsNonRoot {
+		t.Errorf("should run non root with read only root filesystem, got %+v %+v", c.SecurityContext, spec.SecurityContext)
+	}
+	if len(spec.TopologySpreadConstraints) != 2 || spec.TopologySpreadConstraints[0].TopologyKey != "topology.kubernetes.io/zone" {
+		t.Errorf("should spread across zones and nodes, got %+v", spec.TopologySpreadConstraints)
+	}
+	if spec.Affinity.PodAntiAffinity == nil {
+		t.Errorf("should prefer pod anti affinity")
+	}
+	if *spec.TerminationGracePeriodSeconds != defaultTerminationGracePeriodSeconds {
+		t.Errorf("want grace period %v, got %v", defaultTerminationGracePeriodSeconds, *spec.TerminationGracePeriodSeconds)
+	}
+}
+
+func TestPodSpecConfigured(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`
+j8a:
+  pod:
+    terminationGracePeriodSeconds: 180
+    resources:
+      requests:
+        cpu: "1"
+    readinessProbe:
+      httpGet:
+        path: /about
+        port: http
+    topologySpreadConstraints: []
+`), 0644)
+
+	s := NewServer()
+	if e := s.Configure(path, envOf(nil), nil); e != nil {
+		t.Fatalf("should configure, got %v", e)
+	}
+	f := s.Fleets[0]
+	spec := f.desiredDeployment(getInitialJ8aConfig()).Spec.Template.Spec
+	c := spec.Containers[0]
+
+	if *spec.TerminationGracePeriodSeconds != 180 {
+		t.Errorf("want grace period 180, got %v", *spec.TerminationGracePeriodSeconds)
+	}
+	if c.Resources.Requests.Cpu().String() != "1" || !c.Resources.Limits.Memory().IsZero() {
+		t.Errorf("configured resources should replace defaults, got %+v", c.Resources)
+	}
+	if c.ReadinessProbe.HTTPGet == nil || c.LivenessProbe.TCPSocket == nil {
+		t.Errorf("should replace only the configured probe, got %+v %+v", c.ReadinessProbe, c.LivenessProbe)
+	}
+	if len(spec.TopologySpreadConstraints) != 0 {
+		t.Errorf("empty spread constraints should disable the default, got %+v", spec.TopologySpreadConstraints)
+	}
+	if f.Pod.Name != "j8a" || f.Pod.Label["app"] != "j8a" {
+		t.Errorf("unset pod values should keep defaults, got %v %v", f.Pod.Name, f.Pod.Label)
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"reflect"
+	"time"
+)
+
+// FieldManager owns all fields the controller applies with server side apply. Fields set by others are left alone.
+const FieldManager = "ingress-j8a"
+
+const driftMetric = "ingress_j8a_drift_corrections_total"
+
+func applyOptions() metav1.PatchOptions {
+	force := true
+	return metav1.PatchOptions{FieldManager: FieldManager, Force: &force}
+}
+
+// managed is one object of a fleet the controller owns, with typed get and apply of its kind. A shared object, such
+// as the namespace, may belong to several fleets.
+type managed struct {
+	kind   string
+	name   string
+	shared bool
+	want   runtime.Object
+	get    func(ctx context.Context) (runtime.Object, error)
+	apply  func(ctx context.Context, data []byte) error
+}
+
+// reconcile applies the desired state of an object when it is missing, when the desired state changed since it was
+// last applied, or when someone changed the fields we own. The latter is drift, it is logged and counted. An object
+// that exists but is not owned by the fleet is only taken over when the fleet adopts, otherwise it is a conflict.
+func (s *Server) reconcile(ctx context.Context, f *J8a, m managed) error {
+	s.stamp(m.want, f, m.shared)
+	data, e := json.Marshal(m.want)
+	if e != nil {
+		return fmt.Errorf("unable to marshal %v '%v', cause: %v", m.kind, m.name, e)
+	}
+	key := m.kind + "/" + m.name
+	hash := hashOf(string(data))
+
+	live, e := m.get(ctx)
+	if e != nil && !errors.IsNotFound(e) {
+		return fmt.Errorf("unable to fetch %v '%v', cause: %v", m.kind, m.name, e)
+	}
+	found := e == nil
+	adopted := false
+	if found && len(f.applied[key]) == 0 && !owns(live, f, m.shared) {
+		if !f.Adopt {
+			e := conflict(m.kind, m.name, live, f)
+			s.event(live, apiv1.EventTypeWarning, "OwnershipConflict", "%v", e)
+			return e
+		}
+		adopted = true
+	}
+	drift := false
+	if found && f.applied[key] == hash {
+		ok, e := ownedFieldsMatch(data, live)
+		if e != nil {
+			return fmt.Errorf("unable to compare %v '%v', cause: %v", m.kind, m.name, e)
+		}
+		if ok {
+			return nil
+		}
+		drift = true
+	}
+
+	if e := m.apply(ctx, data); e != nil {
+		return fmt.Errorf("unable to apply %v '%v', cause: %v", m.kind, m.name, e)
+	}
+	if f.applied == nil {
+		f.applied = make(map[string]string)
+	}
+	f.applied[key] = hash
+
+	switch {
+	case !found:
+		s.Log.Infof("created %v '%v'", m.kind, m.name)
+	case adopted:
+		s.Log.Infof("adopted %v '%v' into fleet '%v'", m.kind, m.name, f)
+	case drift:
+		s.Log.Infof("restored drifted fields of %v '%v'", m.kind, m.name)
+		s.Metrics.Inc(driftMetric, "corrections of fields the controller owns that were changed by others",
+			map[string]string{"fleet": f.String(), "kind": m.kind, "name": m.name})
+	default:
+		s.Log.Infof("applied %v '%v'", m.kind, m.name)
+	}
+	return nil
+}
+
+// watchOwned signals changed when a deployment, podDisruptionBudget or networkPolicy the controller owns changes, so
+// drift is restored right away. Services and ingressClasses are covered by the informers. Watches the apiserver
+// closes are reopened until ctx is done.
+func (s *Server) watchOwned(ctx context.Context, changed chan<- struct{}) {
+	for _, f := range s.Fleets {
+		f := f
+		byName := func(name string) metav1.ListOptions {
+			return metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()}
+		}
+		watches := []func(context.Context) (watch.Interface, error){
+			func(ctx context.Context) (watch.Interface, error) {
+				return s.Kube.Client.AppsV1().Deployments(f.Namespace).Watch(ctx, byName(f.Deployment.Name))
+			},
+			func(ctx context.Context) (watch.Interface, error) {
+				return s.Kube.Client.PolicyV1().PodDisruptionBudgets(f.Namespace).Watch(ctx, byName(f.Deployment.Name))
+			},
+		}
+		if s.Features.NetworkPolicy {
+			watches = append(watches, func(ctx context.Context) (watch.Interface, error) {
+				return s.Kube.Client.NetworkingV1().NetworkPolicies(f.Namespace).Watch(ctx, byName(f.Deployment.Name))
+			})
+		}
+		for _, w := range watches {
+			go s.watch(ctx, w, changed)
+		}
+	}
+}
+
+func (s *Server) watch(ctx context.Context, open func(context.Context) (watch.Interface, error), changed chan<- struct{}) {
+	for ctx.Err() == nil {
+		w, e := open(ctx)
+		if e != nil {
+			s.Log.Errorf("unable to watch owned objects, cause: %v", e)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second * 10):
+			}
+			continue
+		}
+		for ev := range w.ResultChan() {
+			if ev.Type == watch.Modified || ev.Type == watch.Deleted {
+				notify(changed)
+			}
+		}
+		w.Stop()
+	}
+}
+
+// ownedFieldsMatch is true if every field of the applied object has the same value in the live object. Fields
+// kube defaults or others add to the live object are ignored.
+func ownedFieldsMatch(applied []byte, live runtime.Object) (bool, error) {
+	var want, have interface{}
+	if e := json.Unmarshal(applied, &want); e != nil {
+		return false, e
+	}
+	lb, e := json.Marshal(live)
+	if e != nil {
+		return false, e
+	}
+	if e = json.Unmarshal(lb, &have); e != nil {
+		return false, e
+	}
+	return subset(want, have), nil
+}
+
+func subset(want interface{}, have interface{}) bool {
+	switch w := want.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		h, ok := have.(map[string]interface{})
+		if !ok {
+			return len(w) == 0 && have == nil
+		}
+		for k, wv := range w {
+			if !subset(wv, h[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		h, ok := have.([]interface{})
+		if !ok {
+			return len(w) == 0 && have == nil
+		}
+		//objects in lists are merged by key, others may add their own. Lists of values are owned as a whole.
+		for _, wv := range w {
+			if _, isMap := wv.(map[string]interface{}); !isMap {
+				return reflect.DeepEqual(w, h)
+			}
+			found := false
+			for _, hv := range h {
+				if subset(wv, hv) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(want, have)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestSubset(t *testing.T) {
+	tests := []struct {
+		name string
+		want interface{}
+		have interface{}
+		ok   bool
+	}{
+		{"defaulted field", map[string]interface{}{"a": "1"}, map[string]interface{}{"a": "1", "b": "2"}, true},
+		{"changed field", map[string]interface{}{"a": "1"}, map[string]interface{}{"a": "2"}, false},
+		{"null is unset", map[string]interface{}{"a": nil}, map[string]interface{}{}, true},
+		{"empty is absent", map[string]interface{}{"a": map[string]interface{}{}}, map[string]interface{}{}, true},
+		{"removed field", map[string]interface{}{"a": map[string]interface{}{"b": "1"}}, map[string]interface{}{}, false},
+		{"object added to list", []interface{}{map[string]interface{}{"n": "a"}}, []interface{}{map[string]interface{}{"n": "b"}, map[string]interface{}{"n": "a"}}, true},
+		{"object removed from list", []interface{}{map[string]interface{}{"n": "a"}}, []interface{}{map[string]interface{}{"n": "b"}}, false},
+		{"value added to list", []interface{}{"a"}, []interface{}{"a", "b"}, false},
+	}
+	for _, tt := range tests {
+		if got := subset(tt.want, tt.have); got != tt.ok {
+			t.Errorf("%v: want %v, got %v", tt.name, tt.ok, got)
+		}
+	}
+}
+
+func TestReconcileRestoresDrift(t *testing.T) {
+	s := NewServer()
+	c := newFakeClientset()
+	s.Kube.Client = c
+	f := s.Fleets[0]
+	ctx := context.TODO()
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+
+	d, _ := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	image := d.Spec.Template.Spec.Containers[0].Image
+	d.Spec.Template.Spec.Containers[0].Image = "nginx:latest"
+	s.Kube.Client.AppsV1().Deployments(f.Namespace).Update(ctx, d, metav1.UpdateOptions{})
+
+	svc, _ := s.Kube.Client.CoreV1().Services(f.Namespace).Get(ctx, f.Service, metav1.GetOptions{})
+	svc.Spec.Ports[0].Port = 8080
+	s.Kube.Client.CoreV1().Services(f.Namespace).Update(ctx, svc, metav1.UpdateOptions{})
+
+	ic, _ := s.Kube.Client.NetworkingV1().IngressClasses().Get(ctx, f.IngressClass, metav1.GetOptions{})
+	ic.Annotations = nil
+	s.Kube.Client.NetworkingV1().IngressClasses().Update(ctx, ic, metav1.UpdateOptions{})
+
+	if e := s.updateJ8aDeploymentWithFullClusterConfig(ctx); e != nil {
+		t.Fatalf("should reconcile, got %v", e)
+	}
+
+	d, _ = s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if d.Spec.Template.Spec.Containers[0].Image != image {
+		t.Errorf("should restore image %v, got %v", image, d.Spec.Template.Spec.Containers[0].Image)
+	}
+	svc, _ = s.Kube.Client.CoreV1().Services(f.Namespace).Get(ctx, f.Service, metav1.GetOptions{})
+	found := false
+	for _, p := range svc.Spec.Ports {
+		found = found || p.Port == 80
+	}
+	if !found {
+		t.Errorf("should restore service port 80, got %+v", svc.Spec.Ports)
+	}
+	ic, _ = s.Kube.Client.NetworkingV1().IngressClasses().Get(ctx, f.IngressClass, metav1.GetOptions{})
+	if !isDefaultClass(*ic) {
+		t.Errorf("should restore default class annotation, got %v", ic.Annotations)
+	}
+
+	drifted := map[string]string{"deployment": f.Deployment.Name, "service": f.Service, "ingressClass": f.IngressClass}
+	for kind, name := range drifted {
+		if v, _ := s.Metrics.Get(driftMetric, map[string]string{"fleet": f.String(), "kind": kind, "name": name}); v != 1 {
+			t.Errorf("should count one drift correction of %v, got %v", kind, v)
+		}
+	}
+	if _, ok := s.Metrics.Get(driftMetric, map[string]string{"fleet": f.String(), "kind": "namespace", "name": f.Namespace}); ok {
+		t.Errorf("should not count drift of unchanged namespace")
+	}
+
+	//nothing changed since, so nothing is applied
+	before := len(c.Actions())
+	s.updateJ8aDeploymentWithFullClusterConfig(ctx)
+	for _, a := range c.Actions()[before:] {
+		if a.GetVerb() == "patch" {
+			t.Errorf("should not apply without change, got patch %v", a.GetResource().Resource)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// j8aTemplate is the data for configtemplate.yml
+type j8aTemplate struct {
+	TLS       string
+	ROUTES    string
+	RESOURCES string
+	JWT       string
+	Params    Params
+}
+
+// placeholder keeps j8a valid while a fleet has no routes yet, same as the initial config.
+var placeholderRoute = *NewRoute().WithUpstream("localhost", "59999")
+
+// routes of the latest memento
+func (j *J8a) routes() []Route {
+	if l := len(j.Cache.Mementos); l > 0 {
+		return j.Cache.Mementos[l-1].Routes
+	}
+	return make([]Route, 0)
+}
+
+// renderTLS creates the indented tls section of the downstream connection, empty without tls hosts. The listener
+// serves the default certificate and every other certificate by sni host. Acme hosts are served from the shared acme
+// secret once the controller issued their certificate.
+func (s *Server) renderTLS(ctx context.Context, f *J8a, routes []Route) string {
+	var def *Certificate
+	if len(s.DefaultCertificate) > 0 {
+		c, e := s.fetchCertificate(ctx, s.DefaultCertificate)
+		if e != nil {
+			s.Log.Errorf("unable to serve default certificate, cause: %v", e)
+		} else {
+			def = c
+		}
+	}
+
+	certs := s.sniCertificates(ctx, f, routes, def)
+	if domains := acmeDomains(routes); len(domains) > 0 {
+		//acme hosts are served the default certificate until theirs is issued.
+		c := s.fetchAcmeCertificate(ctx, f, domains, time.Now())
+		if c == nil {
+			c = def
+		}
+		if c != nil {
+			for _, d := range domains {
+				certs[d] = c
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return ""
+	}
+
+	hosts := make([]string, 0, len(certs))
+	for h := range certs {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	var b strings.Builder
+	b.WriteString("tls:")
+	b.WriteString("\n      port: 443")
+	root := def
+	if root == nil {
+		root = certs[hosts[0]]
+	}
+	b.WriteString("\n      cert: |" + indent(root.Cert, 8))
+	b.WriteString("\n      key: |" + indent(root.Key, 8))
+	sni := false
+	for _, h := range hosts {
+		if certs[h] == root {
+			continue
+		}
+		if !sni {
+			b.WriteString("\n      sni:")
+			sni = true
+		}
+		b.WriteString(fmt.Sprintf("\n        - host: %s", h))
+		b.WriteString("\n          cert: |" + indent(certs[h].Cert, 12))
+		b.WriteString("\n          key: |" + indent(certs[h].Key, 12))
+	}
+	return b.String()
+}
+
+// renderJ8aConfig creates the full j8a config of a fleet from its latest routes, params and tls section.
+func renderJ8aConfig(f *J8a, tls string) (string, error) {
+	tmpl, e := template.New("j8aConfigTemplate").Parse(getTemplateJ8aConfig())
+	if e != nil {
+		return "", fmt.Errorf("unable to parse j8a config template, cause: %v", e)
+	}
+
+	routes := f.routes()
+	if len(routes) == 0 {
+		pr := placeholderRoute
+		pr.Path = "/"
+		routes = []Route{pr}
+	}
+
+	var rb, ub, jb strings.Builder
+	seen := make(map[string]bool)
+	seenJwt := make(map[string]bool)
+	for _, r := range routes {
+		rb.WriteString(r.String())
+		if !seen[r.Resource] {
+			seen[r.Resource] = true
+			ub.WriteString(fmt.Sprintf("\n  %s:", r.Resource))
+			ub.WriteString(r.Upstream.String())
+		}
+		if r.JWT != nil && !seenJwt[r.JWT.Name] {
+			seenJwt[r.JWT.Name] = true
+			jb.WriteString(r.JWT.String())
+		}
+	}
+
+	var out strings.Builder
+	e = tmpl.Execute(&out, j8aTemplate{
+		TLS:       tls,
+		ROUTES:    rb.String(),
+		RESOURCES: ub.String(),
+		JWT:       jb.String(),
+		Params:    f.params.withRoutes(routes),
+	})
+	if e != nil {
+		return "", fmt.Errorf("unable to render j8a config for fleet '%v', cause: %v", f, e)
+	}
+	return out.String(), nil
+}
+
+// pruneRejected forgets rejected configs of earlier mementos and rejected images other than the target with the
+// current config. Those cannot render or roll out again as they are, keeping them would only grow the maps.
+func (j *J8a) pruneRejected() {
+	latest := j.Cache.latestHash()
+	for h, m := range j.rejected {
+		if m != latest {
+			delete(j.rejected, h)
+		}
+	}
+	key := j.upgradeKey(j.imageRef())
+	for k := range j.rejectedImages {
+		if k != key {
+			delete(j.rejectedImages, k)
+		}
+	}
+}
+
+// rolloutJ8aConfig pushes the rendered config to the deployment of the fleet. The pod template only changes
+// if the config hash does, which makes kube roll the j8a pods. The rollout is tracked on later calls, a config that
+// failed to roll out is not pushed again.
+func (s *Server) rolloutJ8aConfig(ctx context.Context, f *J8a) error {
+	if e := s.trackRollout(ctx, f); e != nil {
+		return e
+	}
+	config, e := renderJ8aConfig(f, s.renderTLS(ctx, f, f.routes()))
+	if e != nil {
+		return e
+	}
+	hash := hashOf(config)
+	f.pruneRejected()
+	_, rejected := f.rejected[hash]
+	switch {
+	case rejected:
+		//a rejected config is not retried until its inputs change, which changes the hash.
+	case config != f.config:
+		s.Log.Infof("rolling out config '%v' to deployment '%v'", hash, f.Deployment.Name)
+		f.config = config
+		f.rollout = s.startRollout(ctx, f, false, "")
+	}
+	//one change at a time, the image is upgraded once config rolled out.
+	if f.rollout == nil && len(f.config) > 0 {
+		if e := s.upgradeJ8a(ctx, f); e != nil {
+			return e
+		}
+	}
+	return s.reconcileJ8aDeployment(ctx, f)
+}
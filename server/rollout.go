@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"time"
+)
+
+const rolloutsRejectedMetric = "ingress_j8a_rollouts_rejected_total"
+
+// crashLoopRestarts fails a rollout once a container of the new pods restarted this often.
+const crashLoopRestarts = 3
+
+// rollout is a config or image pushed to the deployment, or its canary, that has not become available yet.
+type rollout struct {
+	hash          string
+	config        string
+	memento       string
+	started       time.Time
+	image         string
+	previousImage string
+	canary        bool
+	//restarts of the containers already running when the rollout started, by pod/container.
+	restarts map[string]int32
+}
+
+// startRollout tracks the current config of the fleet on the deployment, or its canary. Restarts of pods already
+// running are counted from here, so crashes before the rollout do not fail it.
+func (s *Server) startRollout(ctx context.Context, f *J8a, canary bool, image string) *rollout {
+	r := &rollout{hash: hashOf(f.config), config: f.config, memento: f.Cache.latestHash(), started: time.Now(),
+		image: image, canary: canary, restarts: make(map[string]int32)}
+	for _, p := range s.rolloutPods(ctx, f, r) {
+		for _, cs := range p.Status.ContainerStatuses {
+			r.restarts[p.Name+"/"+cs.Name] = cs.RestartCount
+		}
+	}
+	return r
+}
+
+type rolloutState int
+
+const (
+	rolloutProgressing rolloutState = iota
+	rolloutComplete
+	rolloutFailed
+)
+
+// trackRollout follows the rollout in flight. A complete rollout marks its memento known-good. A failed one rejects
+// its config hash and reverts the deployment to the last known-good config.
+func (s *Server) trackRollout(ctx context.Context, f *J8a) error {
+	r := f.rollout
+	if r == nil {
+		return nil
+	}
+	d, e := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if e != nil {
+		return fmt.Errorf("unable to fetch deployment '%v', cause: %v", f.Deployment.Name, e)
+	}
+	state, cause := s.rolloutStatus(ctx, f, d, r)
+	switch state {
+	case rolloutComplete:
+		f.Cache.markGood(r.memento, r.config)
+		f.rollout = nil
+		s.Log.Infof("rolled out config '%v' to deployment '%v'", r.hash, f.Deployment.Name)
+	case rolloutFailed:
+		f.rollout = nil
+		if len(r.image) > 0 {
+			//an upgrade rolls out a known-good config, the image is to blame.
+			f.rejectedImages[r.image+" "+r.hash] = true
+			f.image = r.previousImage
+			s.Log.Errorf("rejected image '%v' of deployment '%v', reverting to '%v', cause: %v", r.image, f.Deployment.Name, r.previousImage, cause)
+			s.event(d, apiv1.EventTypeWarning, "UpgradeFailed", "image '%v' rejected, reverting to '%v', cause: %v", r.image, r.previousImage, cause)
+			return s.reconcileJ8aDeployment(ctx, f)
+		}
+		f.rejected[r.hash] = r.memento
+		good := f.knownGoodConfig()
+		s.Log.Errorf("rejected config '%v' of deployment '%v', reverting to '%v', cause: %v", r.hash, f.Deployment.Name, hashOf(good), cause)
+		s.event(d, apiv1.EventTypeWarning, "RolloutFailed", "config '%v' rejected, reverting to '%v', cause: %v", r.hash, hashOf(good), cause)
+		s.Metrics.Inc(rolloutsRejectedMetric, "config rollouts that failed and were reverted to the last known-good config",
+			map[string]string{"fleet": f.String()})
+		f.config = good
+		return s.reconcileJ8aDeployment(ctx, f)
+	}
+	return nil
+}
+
+// rolloutStatus follows the same rules as kubectl rollout status, and fails early on crashlooping new pods. A rollout
+// that completed is never failed. The deadline is the one the deployment controller tracks, its
+// ProgressDeadlineExceeded condition. Status the deployment controller has not observed the rollout in yet, and
+// conditions from before it started, belong to an earlier rollout.
+func (s *Server) rolloutStatus(ctx context.Context, f *J8a, d *appsv1.Deployment, r *rollout) (rolloutState, string) {
+	observed := d.Generation <= d.Status.ObservedGeneration && d.Spec.Template.Annotations[ConfigHashAnnotation] == r.hash
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	st := d.Status
+	if observed && st.UpdatedReplicas >= replicas && st.Replicas <= st.UpdatedReplicas && st.AvailableReplicas >= st.UpdatedReplicas {
+		return rolloutComplete, ""
+	}
+
+	for _, c := range d.Status.Conditions {
+		if observed && c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" && !c.LastUpdateTime.Time.Before(r.started) {
+			return rolloutFailed, fmt.Sprintf("progress deadline exceeded, %v", c.Message)
+		}
+	}
+	if cause := s.crashingPods(ctx, f, r); len(cause) > 0 {
+		return rolloutFailed, cause
+	}
+	return rolloutProgressing, ""
+}
+
+// rolloutPods are the pods of the deployment the rollout is on, the canary pods are told apart by their track.
+func (s *Server) rolloutPods(ctx context.Context, f *J8a, r *rollout) []apiv1.Pod {
+	track, _ := labels.NewRequirement(canaryTrackLabel, selection.DoesNotExist, nil)
+	if r.canary {
+		track, _ = labels.NewRequirement(canaryTrackLabel, selection.Equals, []string{"canary"})
+	}
+	pl, e := s.Kube.Client.CoreV1().Pods(f.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(f.Pod.Label).Add(*track).String(),
+	})
+	if e != nil {
+		s.Log.Errorf("unable to list pods of deployment '%v', cause: %v", f.Deployment.Name, e)
+		return nil
+	}
+	return pl.Items
+}
+
+// crashingPods names the first new pod of the rollout that keeps crashing or cannot start, empty if there is none.
+// New pods run its config hash, and its image if the rollout is an upgrade that keeps the config.
+func (s *Server) crashingPods(ctx context.Context, f *J8a, r *rollout) string {
+	for _, p := range s.rolloutPods(ctx, f, r) {
+		if p.Annotations[ConfigHashAnnotation] != r.hash || (len(r.image) > 0 && podImage(p, f.Pod.Name) != r.image) {
+			continue
+		}
+		for _, cs := range p.Status.ContainerStatuses {
+			if w := cs.State.Waiting; w != nil {
+				switch w.Reason {
+				case "CrashLoopBackOff", "ImagePullBackOff", "ErrImagePull", "CreateContainerConfigError":
+					return fmt.Sprintf("pod '%v' is in %v, %v", p.Name, w.Reason, w.Message)
+				}
+			}
+			if n := cs.RestartCount - r.restarts[p.Name+"/"+cs.Name]; n >= crashLoopRestarts {
+				return fmt.Sprintf("pod '%v' restarted %v times", p.Name, n)
+			}
+		}
+	}
+	return ""
+}
+
+func podImage(p apiv1.Pod, container string) string {
+	for _, c := range p.Spec.Containers {
+		if c.Name == container {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+// knownGoodConfig is the config of the last memento that rolled out, or the config found on the deployment when the
+// controller started.
+func (j *J8a) knownGoodConfig() string {
+	if m := j.Cache.lastGood(); m != nil {
+		return m.Config
+	}
+	return j.adoptedConfig
+}
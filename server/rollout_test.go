@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+	"time"
+)
+
+// completeRollout makes the fake deployment report all replicas updated and available.
+func completeRollout(t *testing.T, s *Server, f *J8a) {
+	completeDeployment(t, s, f.Namespace, f.Deployment.Name)
+}
+
+func completeDeployment(t *testing.T, s *Server, namespace string, name string) {
+	d, _ := s.Kube.Client.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	d.Status = appsv1.DeploymentStatus{Replicas: *d.Spec.Replicas, UpdatedReplicas: *d.Spec.Replicas, AvailableReplicas: *d.Spec.Replicas}
+	if _, e := s.Kube.Client.AppsV1().Deployments(namespace).UpdateStatus(context.TODO(), d, metav1.UpdateOptions{}); e != nil {
+		t.Fatalf("should update deployment status, got %v", e)
+	}
+}
+
+func deployedHash(s *Server, f *J8a) string {
+	d, _ := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(context.TODO(), f.Deployment.Name, metav1.GetOptions{})
+	return d.Spec.Template.Annotations[ConfigHashAnnotation]
+}
+
+func TestRolloutRevertsToKnownGood(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	fr := record.NewFakeRecorder(10)
+	s.Events.recorder = fr
+	f := s.Fleets[0]
+	ctx := context.TODO()
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+
+	completeRollout(t, s, f)
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should track rollout, got %v", e)
+	}
+	good := f.Cache.lastGood()
+	if good == nil || hashOf(good.Config) != deployedHash(s, f) {
+		t.Fatalf("complete rollout should mark memento known-good")
+	}
+
+	//the next config crashloops
+	f.params.MaxBodyBytes = 1024
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should roll out config, got %v", e)
+	}
+	bad := deployedHash(s, f)
+	//the deployment controller starts the new replicaSet
+	d, _ := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	d.Status.UpdatedReplicas = 0
+	s.Kube.Client.AppsV1().Deployments(f.Namespace).UpdateStatus(ctx, d, metav1.UpdateOptions{})
+	s.Kube.Client.CoreV1().Pods(f.Namespace).Create(ctx, &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "j8a-bad", Namespace: f.Namespace, Labels: f.Pod.Label,
+			Annotations: map[string]string{ConfigHashAnnotation: bad}},
+		Status: apiv1.PodStatus{ContainerStatuses: []apiv1.ContainerStatus{{
+			Name:  f.Pod.Name,
+			State: apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		}}},
+	}, metav1.CreateOptions{})
+
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should revert, got %v", e)
+	}
+	if deployedHash(s, f) != hashOf(good.Config) || f.rejected[bad] != f.Cache.latestHash() {
+		t.Errorf("failed rollout should be rejected and reverted to known-good")
+	}
+	if ev := <-fr.Events; !strings.Contains(ev, "RolloutFailed") {
+		t.Errorf("should record event, got %v", ev)
+	}
+	if v, _ := s.Metrics.Get(rolloutsRejectedMetric, map[string]string{"fleet": f.String()}); v != 1 {
+		t.Errorf("should count rejected rollout, got %v", v)
+	}
+
+	//unchanged inputs render the rejected config again, it is not retried
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should reconcile, got %v", e)
+	}
+	if deployedHash(s, f) != hashOf(good.Config) {
+		t.Errorf("rejected config should not be retried")
+	}
+
+	f.params.MaxBodyBytes = 2048
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should roll out config, got %v", e)
+	}
+	if h := deployedHash(s, f); h == hashOf(good.Config) || h == bad {
+		t.Errorf("changed inputs should roll out a new config")
+	}
+}
+
+func TestCrashingPodsOfRolloutOnly(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	f.config = "config"
+	ctx := context.TODO()
+	pod := func(name string, track bool, image string, restarts int32) *apiv1.Pod {
+		l := map[string]string{}
+		for k, v := range f.Pod.Label {
+			l[k] = v
+		}
+		if track {
+			l[canaryTrackLabel] = "canary"
+		}
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: f.Namespace, Labels: l,
+				Annotations: map[string]string{ConfigHashAnnotation: hashOf(f.config)}},
+			Spec: apiv1.PodSpec{Containers: []apiv1.Container{{Name: f.Pod.Name, Image: image}}},
+			Status: apiv1.PodStatus{ContainerStatuses: []apiv1.ContainerStatus{{
+				Name: f.Pod.Name, RestartCount: restarts,
+			}}},
+		}
+	}
+	pods := s.Kube.Client.CoreV1().Pods(f.Namespace)
+	pods.Create(ctx, pod("old", false, "j8a:1.1.0", 3), metav1.CreateOptions{})
+	pods.Create(ctx, pod("canary", true, "j8a:1.2.0", 5), metav1.CreateOptions{})
+
+	r := s.startRollout(ctx, f, false, "j8a:1.2.0")
+	old := pod("old", false, "j8a:1.1.0", 4)
+	pods.Update(ctx, old, metav1.UpdateOptions{})
+	if cause := s.crashingPods(ctx, f, r); len(cause) > 0 {
+		t.Errorf("old and canary pods should not fail the upgrade, got %v", cause)
+	}
+
+	pods.Create(ctx, pod("new", false, "j8a:1.2.0", 3), metav1.CreateOptions{})
+	if cause := s.crashingPods(ctx, f, r); !strings.Contains(cause, "'new'") {
+		t.Errorf("restarting new pod should fail the upgrade, got '%v'", cause)
+	}
+
+	c := s.startRollout(ctx, f, true, "j8a:1.2.0")
+	pods.Update(ctx, pod("canary", true, "j8a:1.2.0", 7), metav1.UpdateOptions{})
+	if cause := s.crashingPods(ctx, f, c); len(cause) > 0 {
+		t.Errorf("restarts before the canary rollout should not count, got %v", cause)
+	}
+	pods.Update(ctx, pod("canary", true, "j8a:1.2.0", 8), metav1.UpdateOptions{})
+	if cause := s.crashingPods(ctx, f, c); !strings.Contains(cause, "'canary'") {
+		t.Errorf("restarting canary should fail the canary, got '%v'", cause)
+	}
+}
+
+func TestRolloutStatusIgnoresEarlierRollouts(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	r := &rollout{hash: "new", started: time.Now(), restarts: make(map[string]int32)}
+	exceeded := func(at time.Time) appsv1.DeploymentCondition {
+		return appsv1.DeploymentCondition{Type: appsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded",
+			LastUpdateTime: metav1.NewTime(at)}
+	}
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Generation: 2},
+		Spec: appsv1.DeploymentSpec{Template: apiv1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ConfigHashAnnotation: "new"}},
+		}},
+		Status: appsv1.DeploymentStatus{ObservedGeneration: 1, Conditions: []appsv1.DeploymentCondition{exceeded(r.started)}},
+	}
+	if state, _ := s.rolloutStatus(context.TODO(), f, d, r); state != rolloutProgressing {
+		t.Errorf("status not observed yet should not fail the rollout, got %v", state)
+	}
+
+	d.Status.ObservedGeneration = 2
+	d.Status.Conditions = []appsv1.DeploymentCondition{exceeded(r.started.Add(-time.Minute))}
+	if state, _ := s.rolloutStatus(context.TODO(), f, d, r); state != rolloutProgressing {
+		t.Errorf("condition of an earlier rollout should not fail the rollout, got %v", state)
+	}
+
+	d.Status.Conditions = []appsv1.DeploymentCondition{exceeded(r.started.Add(time.Minute))}
+	if state, _ := s.rolloutStatus(context.TODO(), f, d, r); state != rolloutFailed {
+		t.Errorf("exceeded deadline of the rollout should fail it, got %v", state)
+	}
+
+	d.Status.Replicas, d.Status.UpdatedReplicas, d.Status.AvailableReplicas = 1, 1, 1
+	if state, _ := s.rolloutStatus(context.TODO(), f, d, r); state != rolloutComplete {
+		t.Errorf("completed rollout should not fail on a stale condition, got %v", state)
+	}
+}
+
+func TestRolloutStatusWithoutDeadlineCondition(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	r := &rollout{hash: "new", started: time.Now().Add(-time.Hour), restarts: make(map[string]int32)}
+	d := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{Template: apiv1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ConfigHashAnnotation: "new"}},
+		}},
+	}
+	if state, _ := s.rolloutStatus(context.TODO(), f, d, r); state != rolloutProgressing {
+		t.Errorf("slow rollout should progress until the deployment reports its deadline exceeded, got %v", state)
+	}
+}
+
+func TestPruneRejected(t *testing.T) {
+	s := NewServer()
+	f := s.Fleets[0]
+	f.config = "config"
+	f.rejected["current"] = f.Cache.latestHash()
+	f.rejected["earlier"] = "memento"
+	f.rejectedImages[f.upgradeKey(f.imageRef())] = true
+	f.rejectedImages[f.upgradeKey("j8a:0.9.0")] = true
+
+	f.pruneRejected()
+	if _, ok := f.rejected["current"]; !ok || len(f.rejected) != 1 {
+		t.Errorf("should keep rejected configs of the latest memento only, got %v", f.rejected)
+	}
+	if len(f.rejectedImages) != 1 || !f.rejectedImages[f.upgradeKey(f.imageRef())] {
+		t.Errorf("should keep the rejected target image only, got %v", f.rejectedImages)
+	}
+}
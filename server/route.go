@@ -3,14 +3,30 @@ package server
 import (
 	"fmt"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"strings"
 )
 
 type Route struct {
-	Path     string
-	Host     string
-	PathType string
-	Resource string
+	Path      string
+	Host      string
+	PathType  string
+	Resource  string
+	Upstream  Upstream
+	Settings  RouteSettings
+	JWT       *JWT
+	ACME      bool
+	TLSSecret string
+	//Ingress is namespace/name of the ingress the route comes from, IngressUID lets events find it.
+	Ingress    string
+	IngressUID types.UID
+}
+
+// Upstream is the url of a j8a resource, the kube service a route forwards to.
+type Upstream struct {
+	Scheme string
+	Host   string
+	Port   string
 }
 
 func NewRoute() *Route {
@@ -19,6 +35,7 @@ func NewRoute() *Route {
 		Host:     "",
 		PathType: "prefix",
 		Resource: "",
+		Upstream: Upstream{Scheme: "http"},
 	}
 }
 
@@ -42,6 +59,25 @@ func NewRouteFrom(path string, host string, pathType *netv1.PathType, resource s
 	return r
 }
 
+// WithUpstream points the route to the service dns name and port. The resource is named after both, so routes
+// to the same service port share one j8a resource.
+func (r *Route) WithUpstream(dnsName string, port string) *Route {
+	r.Upstream.Host = dnsName
+	r.Upstream.Port = port
+	r.Resource = strings.TrimSuffix(dnsName, ".svc.cluster.local") + "-" + port
+	return r
+}
+
+// WithScheme sets the upstream scheme. https upstreams get their own resource, the same service port may be
+// reached with http by another ingress.
+func (r *Route) WithScheme(scheme string) *Route {
+	r.Upstream.Scheme = scheme
+	if scheme != "http" {
+		r.Resource = r.Resource + "-" + scheme
+	}
+	return r
+}
+
 // creates an indented yaml string
 func (r *Route) String() string {
 	var b strings.Builder
@@ -51,10 +87,25 @@ func (r *Route) String() string {
 		b.WriteString(fmt.Sprintf("\n    pathType: %s", r.PathType))
 	}
 	if len(r.Host) > 0 {
-		b.WriteString(fmt.Sprintf("\n    host: %s", r.PathType))
+		b.WriteString(fmt.Sprintf("\n    host: %s", r.Host))
 	}
 
 	b.WriteString(fmt.Sprintf("\n    resource: %s", r.Resource))
+	if r.JWT != nil {
+		b.WriteString(fmt.Sprintf("\n    jwt: %s", r.JWT.Name))
+	}
+
+	return b.String()
+}
+
+// creates an indented yaml string for the j8a resource of this route
+func (u Upstream) String() string {
+	var b strings.Builder
+
+	b.WriteString("\n    - url:")
+	b.WriteString(fmt.Sprintf("\n        scheme: %s", u.Scheme))
+	b.WriteString(fmt.Sprintf("\n        host: %s", u.Host))
+	b.WriteString(fmt.Sprintf("\n        port: %s", u.Port))
 
 	return b.String()
 }
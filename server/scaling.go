@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"strings"
+)
+
+// Autoscaling scales the j8a deployment of a fleet on cpu with a HorizontalPodAutoscaler instead of fixed replicas.
+type Autoscaling struct {
+	MinReplicas                    int `json:"minReplicas,omitempty"`
+	MaxReplicas                    int `json:"maxReplicas"`
+	TargetCPUUtilizationPercentage int `json:"targetCPUUtilizationPercentage,omitempty"`
+}
+
+// handoverManager keeps spec.replicas owned after the controller stops applying it, otherwise server side apply
+// would remove the field and scale the deployment to one before the autoscaler takes over.
+const handoverManager = "ingress-j8a-handover"
+
+var defaultMinAvailable = intstr.FromInt(1)
+
+func (a *Autoscaling) withDefaults() Autoscaling {
+	d := *a
+	if d.MinReplicas == 0 {
+		d.MinReplicas = 2
+	}
+	if d.TargetCPUUtilizationPercentage == 0 {
+		d.TargetCPUUtilizationPercentage = 70
+	}
+	return d
+}
+
+func (d Deployment) validate() error {
+	if m := d.MinAvailable; m != nil {
+		if m.Type == intstr.Int && m.IntVal < 0 {
+			return fmt.Errorf("minAvailable must not be negative, got %v", m.IntVal)
+		}
+		if m.Type == intstr.String {
+			if _, e := intstr.GetScaledValueFromIntOrPercent(m, 100, true); e != nil || !strings.HasSuffix(m.StrVal, "%") {
+				return fmt.Errorf("minAvailable must be a number or percentage, got '%v'", m.StrVal)
+			}
+		}
+	}
+	if d.ProgressDeadlineSeconds != nil && *d.ProgressDeadlineSeconds < 1 {
+		return fmt.Errorf("progressDeadlineSeconds must be positive, got %v", *d.ProgressDeadlineSeconds)
+	}
+	if d.Autoscaling != nil {
+		a := d.Autoscaling.withDefaults()
+		if a.MinReplicas < 1 || a.MaxReplicas < a.MinReplicas {
+			return fmt.Errorf("autoscaling needs 1 <= minReplicas <= maxReplicas, got %v and %v", a.MinReplicas, a.MaxReplicas)
+		}
+		if a.TargetCPUUtilizationPercentage < 1 || a.TargetCPUUtilizationPercentage > 100 {
+			return fmt.Errorf("autoscaling targetCPUUtilizationPercentage must be within 1 and 100, got %v", a.TargetCPUUtilizationPercentage)
+		}
+	}
+	return nil
+}
+
+// reconcileJ8aScaling applies the PodDisruptionBudget of the fleet, and its HorizontalPodAutoscaler if autoscaling is
+// configured. An autoscaler left behind after autoscaling was switched off is deleted.
+func (s *Server) reconcileJ8aScaling(ctx context.Context, f *J8a) error {
+	if e := s.reconcileJ8aDisruptionBudget(ctx, f); e != nil {
+		return e
+	}
+	if f.Deployment.Autoscaling == nil {
+		return s.deleteJ8aAutoscaler(ctx, f)
+	}
+	if !s.Kube.Capabilities.AutoscalingV2 {
+		s.Log.Errorf("unable to autoscale deployment '%v', cluster does not serve autoscaling/v2", f.Deployment.Name)
+		return nil
+	}
+	return s.reconcileJ8aAutoscaler(ctx, f)
+}
+
+func (s *Server) reconcileJ8aDisruptionBudget(ctx context.Context, f *J8a) error {
+	pdbClient := s.Kube.Client.PolicyV1().PodDisruptionBudgets(f.Namespace)
+	minAvailable := defaultMinAvailable
+	if f.Deployment.MinAvailable != nil {
+		minAvailable = *f.Deployment.MinAvailable
+	}
+	return s.reconcile(ctx, f, managed{
+		kind: "podDisruptionBudget",
+		name: f.Deployment.Name,
+		want: &policyv1.PodDisruptionBudget{
+			TypeMeta: metav1.TypeMeta{APIVersion: "policy/v1", Kind: "PodDisruptionBudget"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      f.Deployment.Name,
+				Namespace: f.Namespace,
+			},
+			Spec: policyv1.PodDisruptionBudgetSpec{
+				MinAvailable: &minAvailable,
+				Selector: &metav1.LabelSelector{
+					MatchLabels: f.Pod.Label,
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: canaryTrackLabel, Operator: metav1.LabelSelectorOpDoesNotExist},
+					},
+				},
+			},
+		},
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return pdbClient.Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := pdbClient.Patch(ctx, f.Deployment.Name, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+}
+
+func (s *Server) reconcileJ8aAutoscaler(ctx context.Context, f *J8a) error {
+	hpaClient := s.Kube.Client.AutoscalingV2().HorizontalPodAutoscalers(f.Namespace)
+	a := f.Deployment.Autoscaling.withDefaults()
+	return s.reconcile(ctx, f, managed{
+		kind: "horizontalPodAutoscaler",
+		name: f.Deployment.Name,
+		want: &autoscalingv2.HorizontalPodAutoscaler{
+			TypeMeta: metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      f.Deployment.Name,
+				Namespace: f.Namespace,
+			},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       f.Deployment.Name,
+				},
+				MinReplicas: int32Ptr(int32(a.MinReplicas)),
+				MaxReplicas: int32(a.MaxReplicas),
+				Metrics: []autoscalingv2.MetricSpec{{
+					Type: autoscalingv2.ResourceMetricSourceType,
+					Resource: &autoscalingv2.ResourceMetricSource{
+						Name: apiv1.ResourceCPU,
+						Target: autoscalingv2.MetricTarget{
+							Type:               autoscalingv2.UtilizationMetricType,
+							AverageUtilization: int32Ptr(int32(a.TargetCPUUtilizationPercentage)),
+						},
+					},
+				}},
+			},
+		},
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return hpaClient.Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := hpaClient.Patch(ctx, f.Deployment.Name, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+}
+
+func (s *Server) deleteJ8aAutoscaler(ctx context.Context, f *J8a) error {
+	hpaClient := s.Kube.Client.AutoscalingV2().HorizontalPodAutoscalers(f.Namespace)
+	live, e := hpaClient.Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if errors.IsNotFound(e) {
+		return nil
+	}
+	if e != nil {
+		return fmt.Errorf("unable to fetch horizontalPodAutoscaler '%v', cause: %v", f.Deployment.Name, e)
+	}
+	if e := s.mayDelete("horizontalPodAutoscaler", f.Deployment.Name, live, f); e != nil {
+		return e
+	}
+	if e := hpaClient.Delete(ctx, f.Deployment.Name, metav1.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
+		return fmt.Errorf("unable to delete horizontalPodAutoscaler '%v', cause: %v", f.Deployment.Name, e)
+	}
+	delete(f.applied, "horizontalPodAutoscaler/"+f.Deployment.Name)
+	s.Log.Infof("deleted horizontalPodAutoscaler '%v', autoscaling is off", f.Deployment.Name)
+	return nil
+}
+
+// autoscaled is true if an autoscaler owns the scale of the deployment, replicas are then left to it.
+func (s *Server) autoscaled(f *J8a) bool {
+	return f.Deployment.Autoscaling != nil && s.Kube.Capabilities.AutoscalingV2
+}
+
+// handoverReplicas applies the live replicas under handoverManager once, before the controller stops applying them.
+func (s *Server) handoverReplicas(ctx context.Context, f *J8a, replicas int32) error {
+	data := fmt.Sprintf(`{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":%q,"namespace":%q},"spec":{"replicas":%d}}`,
+		f.Deployment.Name, f.Namespace, replicas)
+	force := true
+	_, e := s.Kube.Client.AppsV1().Deployments(f.Namespace).Patch(ctx, f.Deployment.Name, types.ApplyPatchType, []byte(data),
+		metav1.PatchOptions{FieldManager: handoverManager, Force: &force})
+	if e != nil {
+		return fmt.Errorf("unable to hand replicas of deployment '%v' to autoscaler, cause: %v", f.Deployment.Name, e)
+	}
+	s.Log.Infof("handed %v replicas of deployment '%v' to autoscaler", replicas, f.Deployment.Name)
+	return nil
+}
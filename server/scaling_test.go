@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+func TestDeploymentValidate(t *testing.T) {
+	pct := intstr.FromString("50%")
+	bad := intstr.FromString("half")
+	for _, d := range []Deployment{
+		{MinAvailable: &bad},
+		{Autoscaling: &Autoscaling{MinReplicas: 3, MaxReplicas: 2}},
+		{Autoscaling: &Autoscaling{MaxReplicas: 5, TargetCPUUtilizationPercentage: 120}},
+	} {
+		if d.validate() == nil {
+			t.Errorf("should reject %+v", d)
+		}
+	}
+	if e := (Deployment{MinAvailable: &pct, Autoscaling: &Autoscaling{MaxReplicas: 10}}).validate(); e != nil {
+		t.Errorf("should accept deployment, got %v", e)
+	}
+}
+
+func TestReconcileDisruptionBudget(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	if e := s.Bootstrap(context.TODO()); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+	pdb, e := s.Kube.Client.PolicyV1().PodDisruptionBudgets(f.Namespace).Get(context.TODO(), f.Deployment.Name, metav1.GetOptions{})
+	if e != nil {
+		t.Fatalf("should create pod disruption budget, got %v", e)
+	}
+	if pdb.Spec.MinAvailable.IntValue() != 1 || pdb.Spec.Selector.MatchLabels["app"] != "j8a" {
+		t.Errorf("want minAvailable 1 for j8a pods, got %+v", pdb.Spec)
+	}
+}
+
+func TestAutoscalerOwnsReplicas(t *testing.T) {
+	s := NewServer()
+	c := newFakeClientset()
+	c.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: "autoscaling/v2", APIResources: []metav1.APIResource{{Name: "horizontalpodautoscalers"}}},
+	}
+	s.Kube.Client = c
+	f := s.Fleets[0]
+	f.Deployment.Autoscaling = &Autoscaling{MaxReplicas: 10}
+	ctx := context.TODO()
+	if e := s.Bootstrap(ctx); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+
+	hpa, e := c.AutoscalingV2().HorizontalPodAutoscalers(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if e != nil || *hpa.Spec.MinReplicas != 2 || hpa.Spec.MaxReplicas != 10 {
+		t.Fatalf("should create autoscaler with 2 to 10 replicas, got %+v %v", hpa, e)
+	}
+
+	//the autoscaler scales up, the controller must leave it there
+	d, _ := c.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	d.Spec.Replicas = int32Ptr(7)
+	c.AppsV1().Deployments(f.Namespace).Update(ctx, d, metav1.UpdateOptions{})
+	if e := s.updateJ8aDeploymentWithFullClusterConfig(ctx); e != nil {
+		t.Fatalf("should reconcile, got %v", e)
+	}
+	d, _ = c.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if *d.Spec.Replicas != 7 {
+		t.Errorf("should keep replicas of autoscaler, got %v", *d.Spec.Replicas)
+	}
+	handover := false
+	for _, a := range c.Actions() {
+		if p, ok := a.(k8stesting.PatchAction); ok && p.GetResource().Resource == "deployments" {
+			handover = handover || string(p.GetPatch()) == `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"deployment-j8a","namespace":"j8a"},"spec":{"replicas":2}}`
+		}
+	}
+	if !handover {
+		t.Errorf("should hand replicas over before applying without them")
+	}
+
+	f.Deployment.Autoscaling = nil
+	if e := s.updateJ8aDeploymentWithFullClusterConfig(ctx); e != nil {
+		t.Fatalf("should reconcile, got %v", e)
+	}
+	if _, e := c.AutoscalingV2().HorizontalPodAutoscalers(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{}); e == nil {
+		t.Errorf("should delete autoscaler once autoscaling is off")
+	}
+}
@@ -3,25 +3,18 @@ package server
 import (
 	"context"
 	"errors"
-	"flag"
 	"fmt"
-	corev1 "k8s.io/api/core/v1"
+	authv1 "k8s.io/api/authorization/v1"
 	netv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/discovery"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
-	"k8s.io/klog/v2"
-	"os"
-	"path/filepath"
-	"strconv"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"strings"
 	"time"
 )
 
 const Version = "v0.1.2"
 
+// KubeVersionMinimum is the oldest supported cluster, the controller reconciles with server side apply which went GA in 1.22.
 var KubeVersionMinimum = Kube{
 	Version: KVersion{
 		Major: 1,
@@ -30,79 +23,87 @@ var KubeVersionMinimum = Kube{
 }
 
 type Server struct {
-	Version string
-	Kube    *Kube
-	J8a     *J8a
-	Log     Logger
-	Options map[Option]Option
-	Cache   *Cache
+	Version            string
+	Kube               *Kube
+	Fleets             []*J8a
+	Log                Logger
+	Options            map[Option]Option
+	Features           Features
+	LeaderElection     *LeaderElection
+	ShutdownGrace      time.Duration
+	DefaultCertificate string
+	CertExpiryWarning  time.Duration
+	MetricsAddr        string
+	Metrics            *Metrics
+	Events             *Events
+	Acme               *Acme
+	listers            *listers
 }
 
 type Deployment struct {
-	Name     string
-	Replicas int
-}
-
-type Pod struct {
-	Name  string
-	Label map[string]string
+	Name                    string              `json:"name,omitempty"`
+	Replicas                int                 `json:"replicas,omitempty"`
+	MinAvailable            *intstr.IntOrString `json:"minAvailable,omitempty"`
+	Autoscaling             *Autoscaling        `json:"autoscaling,omitempty"`
+	ProgressDeadlineSeconds *int32              `json:"progressDeadlineSeconds,omitempty"`
 }
 
+// J8a is a fleet of j8a pods behind its own loadbalancer service, serving all ingress resources of one ingressClass.
 type J8a struct {
-	Version      string
-	Image        string
-	Namespace    string
-	IngressClass string
-	Deployment   Deployment
-	Service      string
-	Pod          Pod
-}
-
-type Kube struct {
-	Client  kubernetes.Interface
-	Config  *rest.Config
-	Version KVersion
-}
-
-type KVersion struct {
-	Major int
-	Minor int
+	Name               string            `json:"name,omitempty"`
+	Version            string            `json:"version,omitempty"`
+	Image              string            `json:"image,omitempty"`
+	Digest             string            `json:"digest,omitempty"`
+	ImagePullSecrets   []string          `json:"imagePullSecrets,omitempty"`
+	Upgrade            *Upgrade          `json:"upgrade,omitempty"`
+	Adopt              bool              `json:"adopt,omitempty"`
+	Namespace          string            `json:"namespace,omitempty"`
+	IngressClass       string            `json:"ingressClass,omitempty"`
+	DefaultClass       *bool             `json:"defaultClass,omitempty"`
+	Deployment         Deployment        `json:"deployment,omitempty"`
+	Service            string            `json:"service,omitempty"`
+	ServiceAnnotations map[string]string `json:"serviceAnnotations,omitempty"`
+	LoadBalancer       LoadBalancer      `json:"loadBalancer,omitempty"`
+	Pod                Pod               `json:"pod,omitempty"`
+	Parameters         *ParametersRef    `json:"parameters,omitempty"`
+	ACME               *ACME             `json:"acme,omitempty"`
+	Cache              *Cache            `json:"-"`
+	servesDefault      bool
+	params             Params
+	tlsWarnings        map[string]string
+	config             string
+	applied            map[string]string
+	replicasHandedOver bool
+	adoptedConfig      string
+	rollout            *rollout
+	//rejected config hashes by the memento hash they were rendered from.
+	rejected       map[string]string
+	image          string
+	rejectedImages map[string]bool
+	validated      map[string]bool
+	canary         *rollout
+	acme           *acmeState
 }
 
 type Option string
 
-const (
-	TestNoExit Option = "testNoExit"
-)
-
-// TODO: this method contains a lot of defaults
+// NewServer creates a server with defaults for j8a. Use Configure to override these from a config file,
+// environment variables and flags.
 func NewServer(options ...Option) *Server {
 	return &Server{
 		Version: Version,
 		Kube: &Kube{
 			Client: nil,
 			Config: nil,
+			Auth:   NewAuth(),
 			Version: KVersion{
 				Major: 0,
 				Minor: 0,
+				Patch: 0,
 			},
 		},
-		J8a: &J8a{
-			Version:   "v1.1.0",
-			Image:     "simonmittag/j8a",
-			Namespace: "j8a",
-			Deployment: Deployment{
-				Name:     "deployment-j8a",
-				Replicas: 3,
-			},
-			IngressClass: "ingress-j8a",
-			Service:      "loadbalancer-j8a",
-			Pod: Pod{
-				Name:  "j8a",
-				Label: map[string]string{"app": "j8a"},
-			},
-		},
-		Log: NewKLoggerWrapper(),
+		Fleets: []*J8a{NewJ8a("")},
+		Log:    NewKLoggerWrapper(),
 		Options: func(options ...Option) map[Option]Option {
 			m := make(map[Option]Option)
 			for _, o := range options {
@@ -110,256 +111,188 @@ func NewServer(options ...Option) *Server {
 			}
 			return m
 		}(options...),
-		Cache: NewCache(),
+		Features:          DefaultFeatures(),
+		LeaderElection:    NewLeaderElection(),
+		ShutdownGrace:     time.Second * 30,
+		CertExpiryWarning: time.Hour * 24 * 14,
+		Metrics:           NewMetrics(),
+		Events:            &Events{},
+		Acme:              NewAcme(),
 	}
 }
 
-func (s *Server) Daemon() {
-	for {
-		s.logObjects()
-		time.Sleep(time.Second * 10)
+// NewJ8a creates a fleet with defaults. The unnamed fleet keeps the original names, i.e. 'deployment-j8a' and is the
+// default ingressClass. Named fleets suffix their names and label their pods with the fleet name.
+func NewJ8a(name string) *J8a {
+	suffix := ""
+	label := map[string]string{"app": "j8a"}
+	if len(name) > 0 {
+		suffix = "-" + name
+		label["fleet"] = name
+	}
+	return &J8a{
+		Name:      name,
+		Version:   "v1.1.0",
+		Image:     "simonmittag/j8a",
+		Namespace: "j8a",
+		Deployment: Deployment{
+			Name:     "deployment-j8a" + suffix,
+			Replicas: 3,
+		},
+		IngressClass: "ingress-j8a" + suffix,
+		DefaultClass: boolPtr(len(name) == 0),
+		Service:      "loadbalancer-j8a" + suffix,
+		LoadBalancer: LoadBalancer{
+			Type:    "LoadBalancer",
+			Profile: "aws",
+		},
+		Pod: Pod{
+			Name:  "j8a",
+			Label: label,
+		},
+		Cache:          NewCache(),
+		params:         DefaultParams(),
+		rejected:       make(map[string]string),
+		rejectedImages: make(map[string]bool),
+		validated:      make(map[string]bool),
+		acme:           &acmeState{retry: make(map[string]time.Time)},
 	}
 }
 
-func (s *Server) Bootstrap() *Server {
-	s.authenticate().
-		checkKubeVersion().
-		checkPermissions().
-		createOrDetectJ8aNamespace().
-		createOrDetectJ8aIngressClass().
-		createOrDetectJ8aDeployment().
-		createOrDetectJ8aServiceTypeLoadBalancer().
-		updateJ8aDeploymentWithFullClusterConfig()
+func boolPtr(b bool) *bool { return &b }
 
-	return s
-}
-
-func (s *Server) authenticate() *Server {
-	//TODO for now always authenticate external first to make development easier.
-	//put this behind a flag eventually and do internal as default
-	if e := s.authenticateToKubeExternal(); e != nil {
-		e = s.authenticateToKubeInternal()
-		if e != nil {
-			s.panic(e)
-		}
+// String names the fleet in logs
+func (j *J8a) String() string {
+	if len(j.Name) == 0 {
+		return "default"
 	}
-	return s
+	return j.Name
 }
 
-func (s *Server) authenticateToKubeExternal() error {
-	var kubeconfig *string
-	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "~/.kube/config", "absolute path to the kubeconfig file")
+// Bootstrap runs all phases in order and stops at the first failure. The returned error is a *BootstrapError
+// that names the phase.
+func (s *Server) Bootstrap(ctx context.Context) error {
+	phases := []struct {
+		phase Phase
+		run   func(context.Context) error
+	}{
+		{PhaseAuth, s.authenticate},
+		{PhaseVersion, s.checkKubeVersion},
+		{PhasePermissions, s.checkPermissions},
 	}
-	flag.Parse()
-
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
-	if err != nil {
-		return err
-	} else {
-		s.Kube.Config = config
+	for _, p := range phases {
+		if e := p.run(ctx); e != nil {
+			return &BootstrapError{Phase: p.phase, Err: e}
+		}
 	}
 
-	// create the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err == nil {
-		s.Kube.Client = clientset
-	} else {
-		return err
+	fleetPhases := []struct {
+		phase Phase
+		run   func(context.Context, *J8a) error
+	}{
+		{PhaseNamespace, s.reconcileJ8aNamespace},
+		{PhaseIngressClass, s.reconcileJ8aIngressClass},
+		{PhaseDeployment, s.reconcileJ8aDeployment},
+		{PhaseService, s.reconcileJ8aService},
+		{PhaseScaling, s.reconcileJ8aScaling},
 	}
-
-	apiserver, err := clientset.CoreV1().Services("default").Get(context.TODO(), "kubernetes", metav1.GetOptions{})
-	if err == nil {
-		s.Log.Infof("authenticated external to kubernetes control plane running at %v uid: %v", config.Host, apiserver.ObjectMeta.UID)
-	} else {
-		return err
+	for _, f := range s.Fleets {
+		for _, p := range fleetPhases {
+			if e := p.run(ctx, f); e != nil {
+				return &BootstrapError{Phase: p.phase, Fleet: f.String(), Err: e}
+			}
+		}
 	}
-	return nil
-}
-
-func (s *Server) authenticateToKubeInternal() error {
-	const intErrMsg = "unable to authenticate internal to kubernetes control plane running at %v, cause: %v"
 
-	config, err := rest.InClusterConfig()
-	if err == nil {
-		s.Kube.Config = config
-		clientset, err := kubernetes.NewForConfig(config)
-		if err == nil {
-			s.Kube.Client = clientset
-		} else {
-			s.panic(fmt.Errorf(intErrMsg, config.Host, err))
-		}
-		apiserver, err := clientset.CoreV1().Services("default").Get(context.TODO(), "kubernetes", metav1.GetOptions{})
-		if err == nil {
-			s.Log.Infof("authenticated internal to kubernetes control plane running at %v uid: %v", config.Host, apiserver.ObjectMeta.UID)
-		} else {
-			s.panic(fmt.Errorf(intErrMsg, config.Host, err))
-		}
-	} else {
-		host := "'undefined'"
-		if config != nil {
-			host = config.Host
-		}
-		return fmt.Errorf(intErrMsg, host, err)
+	if e := s.updateJ8aDeploymentWithFullClusterConfig(ctx); e != nil {
+		return &BootstrapError{Phase: PhaseConfig, Err: e}
 	}
 	return nil
 }
 
-func (s *Server) detectKubeVersion() {
-	defer func() {
-		if err := recover(); err != nil {
-			// Handle the panic or error here
-			klog.Error("unable to detect kube version")
-		}
-	}()
-
-	dc, e := discovery.NewDiscoveryClientForConfig(s.Kube.Config)
-
-	vi, e := dc.ServerVersion()
-	if e == nil && vi != nil {
-		s.Kube.Version.Major, _ = strconv.Atoi(vi.Major)
-		s.Kube.Version.Minor, _ = strconv.Atoi(vi.Minor)
+func (s *Server) checkKubeVersion(ctx context.Context) error {
+	if e := s.detectKubeVersion(); e != nil {
+		return e
 	}
-}
-
-func (s *Server) checkKubeVersion() *Server {
-	s.detectKubeVersion()
-	if s.Kube.Version.Major < KubeVersionMinimum.Version.Major ||
-		s.Kube.Version.Minor < KubeVersionMinimum.Version.Minor {
-		e := errors.New(fmt.Sprintf("detected unsupported Kubernetes version %v.%v", s.Kube.Version.Major, s.Kube.Version.Minor))
-		s.panic(e)
-	} else {
-		s.Log.Infof("detected Kubernetes version %v.%v", s.Kube.Version.Major, s.Kube.Version.Minor)
+	if !s.Kube.Version.AtLeast(KubeVersionMinimum.Version) {
+		return fmt.Errorf("detected unsupported Kubernetes version %v, minimum is %v", s.Kube.Version, KubeVersionMinimum.Version)
 	}
-	return s
+	s.Log.Infof("detected Kubernetes version %v", s.Kube.Version)
+	s.detectCapabilities()
+	s.Log.Infof("detected Kubernetes capabilities %v", s.Kube.Capabilities)
+	return nil
 }
 
-func (s *Server) checkPermissions() *Server {
-	insufficient := "insufficient privileges to access "
-	_, e1 := s.fetchConfigMaps()
-	if e1 != nil {
-		s.panic(fmt.Errorf(insufficient+"configMaps", e1))
-	}
-
-	_, e2 := s.fetchServices()
-	if e2 != nil {
-		s.panic(fmt.Errorf(insufficient+"services", e2))
-	}
-
-	_, e3 := s.fetchSecrets()
-	if e3 != nil {
-		s.panic(fmt.Errorf(insufficient+"secrets", e3))
+func (s *Server) checkPermissions(ctx context.Context) error {
+	if missing := s.missingPermissions(ctx); len(missing) > 0 {
+		return fmt.Errorf("insufficient privileges, missing:\n  %v", strings.Join(missing, "\n  "))
 	}
-
-	_, e4 := s.fetchIngress()
-	if e4 != nil {
-		s.panic(fmt.Errorf(insufficient+"ingress", e4))
-	} else {
-		s.Log.Info("successfully checked privileges to access cluster configuration objects in all namespaces")
-	}
-	return s
+	s.Log.Info("successfully checked privileges to access cluster configuration objects in all namespaces")
+	return nil
 }
 
-func (s *Server) logObjects() {
-	cm, _ := s.fetchConfigMaps()
-	s.Log.Infof("detected %d config maps", len(cm.Items))
-	sv, _ := s.fetchServices()
-	s.Log.Infof("detected %d services", len(sv.Items))
-	sl, _ := s.fetchSecrets()
-	s.Log.Infof("detected %d secrets", len(sl.Items))
-	il, _ := s.fetchIngress()
-	s.Log.Infof("detected %d ingress", len(il.Items))
+// missingPermissions asks the apiserver via SelfSubjectAccessReview for every verb and resource the controller
+// requires, cluster wide. It reports all gaps at once instead of failing on the first.
+func (s *Server) missingPermissions(ctx context.Context) []string {
+	missing := make([]string, 0)
+	for _, p := range s.Features.Permissions() {
+		resource, subresource, _ := strings.Cut(p.Resource, "/")
+		for _, v := range p.Verbs {
+			ssar := &authv1.SelfSubjectAccessReview{
+				Spec: authv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authv1.ResourceAttributes{
+						Group:       p.Group,
+						Resource:    resource,
+						Subresource: subresource,
+						Verb:        v,
+					},
+				},
+			}
+			gr := p.Resource
+			if len(p.Group) > 0 {
+				gr = p.Resource + "." + p.Group
+			}
+			r, e := s.Kube.Client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, ssar, metav1.CreateOptions{})
+			if e != nil {
+				missing = append(missing, fmt.Sprintf("%v %v (unable to review, cause: %v)", v, gr, e))
+			} else if !r.Status.Allowed {
+				missing = append(missing, fmt.Sprintf("%v %v", v, gr))
+			}
+		}
+	}
+	return missing
 }
 
-func (s *Server) fetchServices() (*corev1.ServiceList, error) {
-	return s.Kube.Client.CoreV1().Services("").List(
-		context.TODO(),
-		metav1.ListOptions{})
+func (s *Server) FetchBackendServicePort(ctx context.Context, ib netv1.IngressBackend) (string, error) {
+	return s.fetchBackendServicePort(ctx, "default", ib)
 }
 
-func (s *Server) FetchBackendServicePort(ib netv1.IngressBackend) (string, error) {
+func (s *Server) fetchBackendServicePort(ctx context.Context, namespace string, ib netv1.IngressBackend) (string, error) {
 	if ib.Service == nil {
 		return "", errors.New(fmt.Sprintf("invalid cluster config, cannot find service backend"))
 	}
 	b := *ib.Service
 	if len(b.Port.Name) > 0 {
-		servicesClient := s.Kube.Client.CoreV1().Services("default")
-		r, err := servicesClient.Get(context.TODO(), b.Name, metav1.GetOptions{})
+		r, err := s.getService(ctx, namespace, b.Name)
 		if err == nil {
 			for _, p := range r.Spec.Ports {
 				if p.Name == b.Port.Name {
-					return fmt.Sprintf("%v", b.Port.Number), nil
+					return fmt.Sprintf("%v", p.Port), nil
 				}
 			}
 			return "", errors.New(fmt.Sprintf("invalid cluster config cannot find named port %v", b.Port.Name))
 		}
-		return "", errors.New(fmt.Sprintf("invalid cluster config cannot service %v", b.Name))
+		return "", errors.New(fmt.Sprintf("invalid cluster config cannot find service %v", b.Name))
 	} else {
 		//just return port number, this is the default
 		return fmt.Sprintf("%v", b.Port.Number), nil
 	}
 }
 
-func (s *Server) fetchServiceDNSName(b netv1.IngressBackend) string {
-	defaultNs := "default"
-	defaultFqdn := "svc.cluster.local"
-
-	var dnsn string
-	var rsvc corev1.Service
-	svcs, e := s.fetchServices()
-	if e == nil {
-	Services:
-		for _, svc := range svcs.Items {
-			if svc.Name == b.Service.Name {
-				rsvc = svc
-				break Services
-			}
-		}
-		if len(rsvc.Name) > 0 {
-			dnsn = rsvc.Name + "."
-			if len(rsvc.Namespace) > 0 {
-				dnsn = dnsn + rsvc.Namespace
-			} else {
-				dnsn = dnsn + defaultNs
-			}
-			dnsn = dnsn + "." + defaultFqdn
-		} else {
-			dnsn = b.Service.Name + "." + defaultNs + "." + defaultFqdn
-		}
-	} else {
-		dnsn = b.Service.Name + "." + defaultNs + "." + defaultFqdn
-	}
-
-	return dnsn
-}
-
-func (s *Server) fetchConfigMaps() (*corev1.ConfigMapList, error) {
-	return s.Kube.Client.CoreV1().ConfigMaps("").List(
-		context.TODO(),
-		metav1.ListOptions{})
-}
-
-func (s *Server) fetchSecrets() (*corev1.SecretList, error) {
-	return s.Kube.Client.CoreV1().Secrets("").List(
-		context.TODO(),
-		metav1.ListOptions{})
-}
-
-func (s *Server) fetchIngress() (*netv1.IngressList, error) {
-	return s.Kube.Client.NetworkingV1().Ingresses("").List(
-		context.TODO(),
-		metav1.ListOptions{})
-}
-
-func (s *Server) panic(e error) {
-	if !s.hasOption(TestNoExit) {
-		msg := "shutdown cause: %v"
-		s.Log.Fatalf(msg, e)
-		os.Exit(-1)
-	}
+// serviceDNSName is the cluster dns name of the backend service. Ingress can only reference services of its own
+// namespace, so the name is known without looking the service up.
+func serviceDNSName(namespace string, b netv1.IngressBackend) string {
+	return b.Service.Name + "." + namespace + ".svc.cluster.local"
 }
 
 func (s *Server) hasOption(option Option) bool {
@@ -1,12 +1,81 @@
 package server
 
 import (
-	"flag"
+	"context"
+	"encoding/json"
+	"errors"
+	authv1 "k8s.io/api/authorization/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
 	"os"
 	"testing"
 )
 
+// newFakeClientset reports a supported kube version and answers every SelfSubjectAccessReview with allowed,
+// unless the resource is denied.
+func newFakeClientset(denied ...string) *fake.Clientset {
+	c := withApply(fake.NewSimpleClientset())
+	c.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: "v1.27.3"}
+	c.PrependReactor("create", "selfsubjectaccessreviews", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		ssar := a.(k8stesting.CreateAction).GetObject().(*authv1.SelfSubjectAccessReview)
+		ssar.Status.Allowed = true
+		for _, d := range denied {
+			if ssar.Spec.ResourceAttributes.Resource == d {
+				ssar.Status.Allowed = false
+			}
+		}
+		return true, ssar, nil
+	})
+	return c
+}
+
+// withApply lets the fake clientset answer server side apply, which its tracker does not support. The applied
+// object is created, or strategic merged into the existing object, which is close enough for a single manager.
+func withApply(c *fake.Clientset) *fake.Clientset {
+	c.PrependReactor("patch", "*", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		pa := a.(k8stesting.PatchAction)
+		if pa.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		tm := metav1.TypeMeta{}
+		if e := json.Unmarshal(pa.GetPatch(), &tm); e != nil {
+			return true, nil, e
+		}
+		obj, e := scheme.Scheme.New(tm.GroupVersionKind())
+		if e != nil {
+			return true, nil, e
+		}
+		existing, e := c.Tracker().Get(pa.GetResource(), pa.GetNamespace(), pa.GetName())
+		if kerrors.IsNotFound(e) {
+			if e = json.Unmarshal(pa.GetPatch(), obj); e != nil {
+				return true, nil, e
+			}
+			return true, obj, c.Tracker().Create(pa.GetResource(), obj, pa.GetNamespace())
+		}
+		if e != nil {
+			return true, nil, e
+		}
+		eb, _ := json.Marshal(existing)
+		merged, e := strategicpatch.StrategicMergePatch(eb, pa.GetPatch(), obj)
+		if e != nil {
+			return true, nil, e
+		}
+		if e = json.Unmarshal(merged, obj); e != nil {
+			return true, nil, e
+		}
+		return true, obj, c.Tracker().Update(pa.GetResource(), obj, pa.GetNamespace())
+	})
+	return c
+}
+
 func TestNewServer(t *testing.T) {
 	s := NewServer()
 	s.Log.Info("thou shalt pass")
@@ -16,18 +85,62 @@ func TestNewServer(t *testing.T) {
 	}
 }
 
+const unreachableKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: unreachable
+  cluster:
+    server: https://127.0.0.1:1
+contexts:
+- name: ctx
+  context:
+    cluster: unreachable
+    user: u
+users:
+- name: u
+  user:
+    token: t
+`
+
+func TestAuthenticateDefaultsInternal(t *testing.T) {
+	s := NewServer()
+	if s.Kube.Auth.external() {
+		t.Errorf("should authenticate in-cluster by default")
+	}
+	s.Kube.Auth.Context = "ctx"
+	if !s.Kube.Auth.external() {
+		t.Errorf("should authenticate external with context")
+	}
+}
+
 func TestAuthenticateToKubeExternal(t *testing.T) {
+	f, _ := os.CreateTemp(t.TempDir(), "kubeconfig")
+	f.WriteString(unreachableKubeconfig)
+	f.Close()
+
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
+	s.Kube.Auth.Kubeconfig = f.Name()
+	s.Kube.Auth.Context = "ctx"
 
-	s.authenticateToKubeExternal()
+	e := s.authenticateToKube(context.TODO())
+	if e == nil {
+		t.Errorf("should not authenticate to unreachable apiserver")
+	}
+	if s.Kube.Client != nil {
+		t.Errorf("should not keep client after failed authentication")
+	}
+
+	s.Kube.Auth.Context = "doesnotexist"
+	if e := s.authenticateToKube(context.TODO()); e == nil {
+		t.Errorf("should not authenticate with unknown context")
+	}
 }
 
 func TestAuthenticateToKubeInternal(t *testing.T) {
 	s := NewServer()
 	s.Kube.Client = fake.NewSimpleClientset()
 
-	e := s.authenticateToKubeInternal()
+	e := s.authenticateToKubeInternal(context.TODO())
 	if e == nil {
 		t.Errorf("should not authenticate outside cluster")
 	}
@@ -35,38 +148,90 @@ func TestAuthenticateToKubeInternal(t *testing.T) {
 
 func TestDetectKubeVersion(t *testing.T) {
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
+	s.Kube.Client = newFakeClientset()
 
-	s.detectKubeVersion()
+	if e := s.detectKubeVersion(); e != nil {
+		t.Errorf("should detect kube version, got %v", e)
+	}
+	if s.Kube.Version != (KVersion{1, 27, 3}) {
+		t.Errorf("want kube version 1.27.3, got %v", s.Kube.Version)
+	}
 }
 
 func TestCheckPermissions(t *testing.T) {
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
+	s.Kube.Client = newFakeClientset()
 
-	s.checkPermissions()
+	if e := s.checkPermissions(context.TODO()); e != nil {
+		t.Errorf("should have all permissions, got %v", e)
+	}
 }
 
-func TestLogObjects(t *testing.T) {
+func TestMissingPermissions(t *testing.T) {
 	s := NewServer()
-	s.Kube.Client = fake.NewSimpleClientset()
+	s.Kube.Client = newFakeClientset("secrets", "ingressclasses")
 
-	s.logObjects()
+	got := s.missingPermissions(context.TODO())
+	//3 verbs on secrets, 6 on ingressclasses
+	if len(got) != 9 {
+		t.Errorf("want 9 missing permissions, got %v: %v", len(got), got)
+	}
+
+	s.Kube.Client = newFakeClientset()
+	if got := s.missingPermissions(context.TODO()); len(got) != 0 {
+		t.Errorf("want no missing permissions, got %v", got)
+	}
 }
 
 func TestBootstrap(t *testing.T) {
-	//uses a flag that needs resetting
-	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
 
-	s := NewServer(TestNoExit)
-	s.Kube.Client = fake.NewSimpleClientset()
+	if e := s.Bootstrap(context.TODO()); e != nil {
+		t.Errorf("should bootstrap with fake client, got %v", e)
+	}
+}
 
-	s.Bootstrap()
+func TestBootstrapPhaseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		client func() *fake.Clientset
+		phase  Phase
+	}{
+		{"permissions", func() *fake.Clientset { return newFakeClientset("deployments") }, PhasePermissions},
+		{"version", func() *fake.Clientset {
+			c := newFakeClientset()
+			c.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: "v1.21.14"}
+			return c
+		}, PhaseVersion},
+	}
+	for _, tt := range tests {
+		s := NewServer()
+		s.Kube.Client = tt.client()
+
+		e := s.Bootstrap(context.TODO())
+		var be *BootstrapError
+		if !errors.As(e, &be) || be.Phase != tt.phase {
+			t.Errorf("%v: want bootstrap error in phase %v, got %v", tt.name, tt.phase, e)
+		}
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if e := s.Run(ctx); e != nil {
+		t.Errorf("run should return without error on cancelled context, got %v", e)
+	}
 }
 
 func TestOptions(t *testing.T) {
-	s := NewServer(TestNoExit)
-	if !s.hasOption(TestNoExit) {
+	o := Option("testOption")
+	s := NewServer(o)
+	if !s.hasOption(o) {
 		t.Errorf("needs to have test option")
 	}
 }
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// LoadBalancer configures the service in front of the j8a pods of a fleet. The profile sets annotations and
+// defaults for a cloud or bare metal loadbalancer, explicit settings and ServiceAnnotations override it.
+type LoadBalancer struct {
+	Type                     string   `json:"type,omitempty"`
+	Profile                  string   `json:"profile,omitempty"`
+	HTTPNodePort             int32    `json:"httpNodePort,omitempty"`
+	HTTPSNodePort            int32    `json:"httpsNodePort,omitempty"`
+	ExternalTrafficPolicy    string   `json:"externalTrafficPolicy,omitempty"`
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+	IPFamilies               []string `json:"ipFamilies,omitempty"`
+	IPFamilyPolicy           string   `json:"ipFamilyPolicy,omitempty"`
+}
+
+type profile struct {
+	annotations           map[string]string
+	externalTrafficPolicy string
+}
+
+var profiles = map[string]profile{
+	"aws": {annotations: map[string]string{
+		"service.beta.kubernetes.io/aws-load-balancer-type": "nlb",
+	}},
+	"gcp": {annotations: map[string]string{
+		"cloud.google.com/l4-rbs": "enabled",
+	}},
+	"azure": {annotations: map[string]string{
+		"service.beta.kubernetes.io/port_80_health-probe_protocol":  "tcp",
+		"service.beta.kubernetes.io/port_443_health-probe_protocol": "tcp",
+	}},
+	//layer 2 mode announces from the node with the pod, Local keeps the client ip
+	"metallb": {externalTrafficPolicy: string(apiv1.ServiceExternalTrafficPolicyLocal)},
+	"none":    {},
+}
+
+func (l LoadBalancer) validate() error {
+	if _, ok := profiles[l.Profile]; len(l.Profile) > 0 && !ok {
+		return fmt.Errorf("unknown service profile '%v', want one of aws, gcp, azure, metallb, none", l.Profile)
+	}
+	switch apiv1.ServiceType(l.Type) {
+	case "", apiv1.ServiceTypeLoadBalancer, apiv1.ServiceTypeNodePort:
+	case apiv1.ServiceTypeClusterIP:
+		if l.HTTPNodePort > 0 || l.HTTPSNodePort > 0 || len(l.ExternalTrafficPolicy) > 0 {
+			return fmt.Errorf("service type ClusterIP takes no nodePorts or externalTrafficPolicy")
+		}
+	default:
+		return fmt.Errorf("unsupported service type '%v', want LoadBalancer, NodePort or ClusterIP", l.Type)
+	}
+	if len(l.LoadBalancerSourceRanges) > 0 && len(l.Type) > 0 && l.Type != string(apiv1.ServiceTypeLoadBalancer) {
+		return fmt.Errorf("loadBalancerSourceRanges need service type LoadBalancer")
+	}
+	switch apiv1.ServiceExternalTrafficPolicy(l.ExternalTrafficPolicy) {
+	case "", apiv1.ServiceExternalTrafficPolicyCluster, apiv1.ServiceExternalTrafficPolicyLocal:
+	default:
+		return fmt.Errorf("unsupported externalTrafficPolicy '%v', want Cluster or Local", l.ExternalTrafficPolicy)
+	}
+	for _, f := range l.IPFamilies {
+		if f != string(apiv1.IPv4Protocol) && f != string(apiv1.IPv6Protocol) {
+			return fmt.Errorf("unsupported ipFamily '%v', want IPv4 or IPv6", f)
+		}
+	}
+	switch apiv1.IPFamilyPolicy(l.IPFamilyPolicy) {
+	case "", apiv1.IPFamilyPolicySingleStack, apiv1.IPFamilyPolicyPreferDualStack, apiv1.IPFamilyPolicyRequireDualStack:
+	default:
+		return fmt.Errorf("unsupported ipFamilyPolicy '%v'", l.IPFamilyPolicy)
+	}
+	return nil
+}
+
+func (l *LoadBalancer) merge(o LoadBalancer) {
+	mergeString(&l.Type, o.Type)
+	mergeString(&l.Profile, o.Profile)
+	mergeString(&l.ExternalTrafficPolicy, o.ExternalTrafficPolicy)
+	mergeString(&l.IPFamilyPolicy, o.IPFamilyPolicy)
+	if o.HTTPNodePort > 0 {
+		l.HTTPNodePort = o.HTTPNodePort
+	}
+	if o.HTTPSNodePort > 0 {
+		l.HTTPSNodePort = o.HTTPSNodePort
+	}
+	if o.LoadBalancerSourceRanges != nil {
+		l.LoadBalancerSourceRanges = o.LoadBalancerSourceRanges
+	}
+	if o.IPFamilies != nil {
+		l.IPFamilies = o.IPFamilies
+	}
+}
+
+// desiredService is the service of the fleet as configured, with profile defaults applied.
+func (f *J8a) desiredService() *apiv1.Service {
+	lb := f.LoadBalancer
+	p := profiles[lb.Profile]
+	annotations := make(map[string]string)
+	for k, v := range p.annotations {
+		annotations[k] = v
+	}
+	for k, v := range f.ServiceAnnotations {
+		annotations[k] = v
+	}
+
+	svcType := apiv1.ServiceType(lb.Type)
+	if len(svcType) == 0 {
+		svcType = apiv1.ServiceTypeLoadBalancer
+	}
+	svc := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        f.Service,
+			Namespace:   f.Namespace,
+			Annotations: annotations,
+		},
+		Spec: apiv1.ServiceSpec{
+			Selector: f.Pod.Label,
+			Type:     svcType,
+			Ports: []apiv1.ServicePort{
+				{
+					Name:       "http",
+					Protocol:   apiv1.ProtocolTCP,
+					Port:       80,
+					TargetPort: intstr.FromInt(80),
+				},
+				{
+					Name:       "https",
+					Protocol:   apiv1.ProtocolTCP,
+					Port:       443,
+					TargetPort: intstr.FromInt(443),
+				},
+			},
+			LoadBalancerSourceRanges: lb.LoadBalancerSourceRanges,
+		},
+	}
+	if svcType != apiv1.ServiceTypeClusterIP {
+		svc.Spec.Ports[0].NodePort = lb.HTTPNodePort
+		svc.Spec.Ports[1].NodePort = lb.HTTPSNodePort
+		etp := lb.ExternalTrafficPolicy
+		if len(etp) == 0 {
+			etp = p.externalTrafficPolicy
+		}
+		if len(etp) > 0 {
+			svc.Spec.ExternalTrafficPolicy = apiv1.ServiceExternalTrafficPolicy(etp)
+		}
+	}
+	for _, fam := range lb.IPFamilies {
+		svc.Spec.IPFamilies = append(svc.Spec.IPFamilies, apiv1.IPFamily(fam))
+	}
+	if len(lb.IPFamilyPolicy) > 0 {
+		pol := apiv1.IPFamilyPolicy(lb.IPFamilyPolicy)
+		svc.Spec.IPFamilyPolicy = &pol
+	}
+	return svc
+}
+
+// reconcileJ8aService applies the service of the fleet. Values kube allocated, such as nodePorts we did not ask
+// for, are not owned by the controller and kept.
+func (s *Server) reconcileJ8aService(ctx context.Context, f *J8a) error {
+	servicesClient := s.Kube.Client.CoreV1().Services(f.Namespace)
+	want := f.desiredService()
+	want.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+
+	return s.reconcile(ctx, f, managed{
+		kind: "service",
+		name: f.Service,
+		want: want,
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return servicesClient.Get(ctx, f.Service, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := servicesClient.Patch(ctx, f.Service, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+}
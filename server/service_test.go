@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestDesiredServiceProfiles(t *testing.T) {
+	f := NewJ8a("")
+	if svc := f.desiredService(); svc.Annotations["service.beta.kubernetes.io/aws-load-balancer-type"] != "nlb" {
+		t.Errorf("aws profile should be the default, got %v", svc.Annotations)
+	}
+
+	f.LoadBalancer.Profile = "metallb"
+	f.ServiceAnnotations = map[string]string{"metallb.universe.tf/address-pool": "edge"}
+	svc := f.desiredService()
+	if svc.Spec.ExternalTrafficPolicy != apiv1.ServiceExternalTrafficPolicyLocal || len(svc.Annotations) != 1 {
+		t.Errorf("metallb profile should keep client ip and user annotations, got %+v %v", svc.Spec, svc.Annotations)
+	}
+
+	f.LoadBalancer = LoadBalancer{Type: "NodePort", Profile: "none", HTTPNodePort: 30080, IPFamilies: []string{"IPv6"}}
+	svc = f.desiredService()
+	if svc.Spec.Type != apiv1.ServiceTypeNodePort || svc.Spec.Ports[0].NodePort != 30080 || svc.Spec.IPFamilies[0] != apiv1.IPv6Protocol {
+		t.Errorf("unexpected node port service %+v", svc.Spec)
+	}
+}
+
+func TestLoadBalancerValidate(t *testing.T) {
+	for _, bad := range []LoadBalancer{
+		{Profile: "openstack"},
+		{Type: "ExternalName"},
+		{Type: "ClusterIP", HTTPNodePort: 30080},
+		{Type: "NodePort", LoadBalancerSourceRanges: []string{"10.0.0.0/8"}},
+		{ExternalTrafficPolicy: "Nearby"},
+		{IPFamilies: []string{"IPv5"}},
+		{IPFamilyPolicy: "TripleStack"},
+	} {
+		if bad.validate() == nil {
+			t.Errorf("should reject %+v", bad)
+		}
+	}
+	if e := (LoadBalancer{Type: "LoadBalancer", Profile: "gcp", LoadBalancerSourceRanges: []string{"10.0.0.0/8"}}).validate(); e != nil {
+		t.Errorf("should accept loadbalancer, got %v", e)
+	}
+}
+
+func TestReconcileJ8aServiceKeepsNodePorts(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	f := s.Fleets[0]
+	if e := s.reconcileJ8aService(context.TODO(), f); e != nil {
+		t.Fatalf("should create service, got %v", e)
+	}
+
+	//kube allocated a node port, it must survive the update
+	svc, _ := s.Kube.Client.CoreV1().Services(f.Namespace).Get(context.TODO(), f.Service, metav1.GetOptions{})
+	svc.Spec.Ports[1].NodePort = 31443
+	s.Kube.Client.CoreV1().Services(f.Namespace).Update(context.TODO(), svc, metav1.UpdateOptions{})
+
+	f.LoadBalancer = LoadBalancer{Type: "NodePort", Profile: "none", HTTPNodePort: 30080}
+	if e := s.reconcileJ8aService(context.TODO(), f); e != nil {
+		t.Fatalf("should update service, got %v", e)
+	}
+	svc, _ = s.Kube.Client.CoreV1().Services(f.Namespace).Get(context.TODO(), f.Service, metav1.GetOptions{})
+	if svc.Spec.Type != apiv1.ServiceTypeNodePort || svc.Spec.Ports[0].NodePort != 30080 || svc.Spec.Ports[1].NodePort != 31443 {
+		t.Errorf("service should be reconciled to node port, got %+v", svc.Spec)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"text/tabwriter"
+)
+
+type Status struct {
+	Controller   string        `json:"controller"`
+	KubeVersion  string        `json:"kubeVersion"`
+	Capabilities Capabilities  `json:"capabilities"`
+	Fleets       []FleetStatus `json:"fleets"`
+}
+
+type FleetStatus struct {
+	Name         string             `json:"name"`
+	IngressClass IngressClassStatus `json:"ingressClass"`
+	Deployment   DeploymentStatus   `json:"deployment"`
+	LoadBalancer LoadBalancerStatus `json:"loadBalancer"`
+	ConfigHash   string             `json:"configHash"`
+	Ingresses    []IngressStatus    `json:"ingresses"`
+}
+
+type IngressClassStatus struct {
+	Name          string `json:"name"`
+	Found         bool   `json:"found"`
+	Default       bool   `json:"default"`
+	ServesDefault bool   `json:"servesDefault"`
+}
+
+type DeploymentStatus struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Found     bool   `json:"found"`
+	Image     string `json:"image"`
+	Ready     int32  `json:"ready"`
+	Desired   int32  `json:"desired"`
+}
+
+type LoadBalancerStatus struct {
+	Name    string   `json:"name"`
+	Found   bool     `json:"found"`
+	Address []string `json:"address"`
+}
+
+type IngressStatus struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Accepted  bool   `json:"accepted"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Status authenticates to the cluster and collects a read only summary of the controller, the j8a fleet
+// and all ingress resources for our ingressClass. It never creates or modifies objects.
+func (s *Server) Status(ctx context.Context) (*Status, error) {
+	if e := s.authenticate(ctx); e != nil {
+		return nil, &BootstrapError{Phase: PhaseAuth, Err: e}
+	}
+	return s.collectStatus(ctx), nil
+}
+
+func (s *Server) collectStatus(ctx context.Context) *Status {
+	if e := s.detectKubeVersion(); e != nil {
+		s.Log.Errorf("%v", e)
+	}
+	s.detectCapabilities()
+	if e := s.detectDefaultClass(ctx); e != nil {
+		s.Log.Errorf("%v", e)
+	}
+	st := &Status{
+		Controller:   s.Version,
+		KubeVersion:  s.Kube.Version.String(),
+		Capabilities: s.Kube.Capabilities,
+		Fleets:       make([]FleetStatus, 0),
+	}
+	for _, f := range s.Fleets {
+		st.Fleets = append(st.Fleets, s.collectFleetStatus(ctx, f))
+	}
+
+	il, e := s.fetchIngress(ctx)
+	if e == nil {
+		for _, igrs := range il.Items {
+			for i, f := range s.Fleets {
+				if f.matches(igrs) {
+					is := IngressStatus{
+						Namespace: igrs.Namespace,
+						Name:      igrs.Name,
+						Accepted:  true,
+					}
+					if _, e := s.translateIngress(ctx, igrs); e != nil {
+						is.Accepted = false
+						is.Reason = e.Error()
+					}
+					st.Fleets[i].Ingresses = append(st.Fleets[i].Ingresses, is)
+				}
+			}
+		}
+	}
+
+	return st
+}
+
+func (s *Server) collectFleetStatus(ctx context.Context, f *J8a) FleetStatus {
+	fs := FleetStatus{
+		Name: f.String(),
+		IngressClass: IngressClassStatus{
+			Name: f.IngressClass,
+		},
+		Deployment: DeploymentStatus{
+			Name:      f.Deployment.Name,
+			Namespace: f.Namespace,
+		},
+		LoadBalancer: LoadBalancerStatus{
+			Name:    f.Service,
+			Address: make([]string, 0),
+		},
+		Ingresses: make([]IngressStatus, 0),
+	}
+
+	ic, e := s.Kube.Client.NetworkingV1().IngressClasses().Get(ctx, f.IngressClass, metav1.GetOptions{})
+	if e == nil {
+		fs.IngressClass.Found = true
+		fs.IngressClass.Default = isDefaultClass(*ic)
+		fs.IngressClass.ServesDefault = f.servesDefault
+	}
+
+	d, e := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{})
+	if e == nil {
+		fs.Deployment.Found = true
+		fs.Deployment.Ready = d.Status.ReadyReplicas
+		if d.Spec.Replicas != nil {
+			fs.Deployment.Desired = *d.Spec.Replicas
+		}
+		for _, c := range d.Spec.Template.Spec.Containers {
+			if c.Name == f.Pod.Name {
+				fs.Deployment.Image = c.Image
+			}
+		}
+		fs.ConfigHash = d.Spec.Template.Annotations[ConfigHashAnnotation]
+	}
+
+	svc, e := s.Kube.Client.CoreV1().Services(f.Namespace).Get(ctx, f.Service, metav1.GetOptions{})
+	if e == nil {
+		fs.LoadBalancer.Found = true
+		for _, i := range svc.Status.LoadBalancer.Ingress {
+			if len(i.Hostname) > 0 {
+				fs.LoadBalancer.Address = append(fs.LoadBalancer.Address, i.Hostname)
+			} else if len(i.IP) > 0 {
+				fs.LoadBalancer.Address = append(fs.LoadBalancer.Address, i.IP)
+			}
+		}
+	}
+	return fs
+}
+
+func (st *Status) JSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(st)
+}
+
+func (st *Status) Table(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "CONTROLLER\t%v\n", st.Controller)
+	fmt.Fprintf(tw, "KUBERNETES\t%v\t%v\n", st.KubeVersion, st.Capabilities)
+	for _, fs := range st.Fleets {
+		fmt.Fprintln(tw)
+		fmt.Fprintf(tw, "FLEET\t%v\n", fs.Name)
+		fmt.Fprintf(tw, "INGRESSCLASS\t%v\t%v\n", fs.IngressClass.Name, found(fs.IngressClass.Found, fmt.Sprintf("default=%v servesDefault=%v", fs.IngressClass.Default, fs.IngressClass.ServesDefault)))
+		fmt.Fprintf(tw, "DEPLOYMENT\t%v/%v\t%v\n", fs.Deployment.Namespace, fs.Deployment.Name,
+			found(fs.Deployment.Found, fmt.Sprintf("ready=%v/%v image=%v", fs.Deployment.Ready, fs.Deployment.Desired, fs.Deployment.Image)))
+		fmt.Fprintf(tw, "LOADBALANCER\t%v\t%v\n", fs.LoadBalancer.Name, found(fs.LoadBalancer.Found, orPending(strings.Join(fs.LoadBalancer.Address, ","))))
+		fmt.Fprintf(tw, "CONFIGHASH\t%v\n", orPending(fs.ConfigHash))
+		fmt.Fprintln(tw)
+
+		fmt.Fprintln(tw, "INGRESS\tSTATE\tREASON")
+		for _, i := range fs.Ingresses {
+			state := "accepted"
+			if !i.Accepted {
+				state = "rejected"
+			}
+			fmt.Fprintf(tw, "%v/%v\t%v\t%v\n", i.Namespace, i.Name, state, i.Reason)
+		}
+	}
+	return tw.Flush()
+}
+
+func found(ok bool, detail string) string {
+	if !ok {
+		return "not found"
+	}
+	return detail
+}
+
+func orPending(v string) string {
+	if len(v) == 0 {
+		return "<pending>"
+	}
+	return v
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+func ingressFor(name string, class string, port netv1.ServiceBackendPort) *netv1.Ingress {
+	return &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: netv1.IngressSpec{
+			IngressClassName: &class,
+			Rules: []netv1.IngressRule{{
+				IngressRuleValue: netv1.IngressRuleValue{
+					HTTP: &netv1.HTTPIngressRuleValue{
+						Paths: []netv1.HTTPIngressPath{{
+							Path: "/foo",
+							Backend: netv1.IngressBackend{
+								Service: &netv1.IngressServiceBackend{Name: "s1", Port: port},
+							},
+						}},
+					},
+				},
+			}},
+		},
+	}
+}
+
+func TestCollectStatus(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = fake.NewSimpleClientset(
+		&netv1.IngressClass{ObjectMeta: metav1.ObjectMeta{
+			Name:        s.Fleets[0].IngressClass,
+			Annotations: map[string]string{defaultClassAnnotation: "true"},
+		}},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: s.Fleets[0].Deployment.Name, Namespace: s.Fleets[0].Namespace},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: int32Ptr(3),
+				Template: apiv1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ConfigHashAnnotation: "abc"}},
+					Spec:       apiv1.PodSpec{Containers: []apiv1.Container{{Name: s.Fleets[0].Pod.Name, Image: "simonmittag/j8a:1.1.0"}}},
+				},
+			},
+			Status: appsv1.DeploymentStatus{ReadyReplicas: 2},
+		},
+		&apiv1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: s.Fleets[0].Service, Namespace: s.Fleets[0].Namespace},
+			Status: apiv1.ServiceStatus{LoadBalancer: apiv1.LoadBalancerStatus{
+				Ingress: []apiv1.LoadBalancerIngress{{Hostname: "lb.example.com"}},
+			}},
+		},
+		ingressFor("accepted", s.Fleets[0].IngressClass, netv1.ServiceBackendPort{Number: 80}),
+		ingressFor("rejected", s.Fleets[0].IngressClass, netv1.ServiceBackendPort{Name: "http"}),
+		ingressFor("other", "nginx", netv1.ServiceBackendPort{Number: 80}),
+	)
+
+	st := s.collectStatus(context.TODO()).Fleets[0]
+	if !st.IngressClass.Found || !st.IngressClass.Default {
+		t.Errorf("ingress class should be found and default, got %+v", st.IngressClass)
+	}
+	if st.Deployment.Ready != 2 || st.Deployment.Desired != 3 || st.Deployment.Image != "simonmittag/j8a:1.1.0" {
+		t.Errorf("unexpected deployment status %+v", st.Deployment)
+	}
+	if len(st.LoadBalancer.Address) != 1 || st.LoadBalancer.Address[0] != "lb.example.com" {
+		t.Errorf("unexpected load balancer status %+v", st.LoadBalancer)
+	}
+	if st.ConfigHash != "abc" {
+		t.Errorf("want config hash abc, got %v", st.ConfigHash)
+	}
+	if len(st.Ingresses) != 2 {
+		t.Fatalf("want 2 class matched ingresses, got %v", len(st.Ingresses))
+	}
+	for _, i := range st.Ingresses {
+		switch i.Name {
+		case "accepted":
+			if !i.Accepted {
+				t.Errorf("ingress should be accepted, got reason %v", i.Reason)
+			}
+		case "rejected":
+			if i.Accepted || len(i.Reason) == 0 {
+				t.Errorf("ingress with unknown named port should be rejected with reason")
+			}
+		}
+	}
+
+	var tb bytes.Buffer
+	(&Status{Fleets: []FleetStatus{st}}).Table(&tb)
+	if !strings.Contains(tb.String(), "default/rejected") {
+		t.Errorf("table should list rejected ingress, got\n%v", tb.String())
+	}
+
+	var jb bytes.Buffer
+	(&Status{Fleets: []FleetStatus{st}}).JSON(&jb)
+	var got Status
+	if e := json.Unmarshal(jb.Bytes(), &got); e != nil || got.Fleets[0].ConfigHash != "abc" {
+		t.Errorf("json should round trip, got %v", e)
+	}
+}
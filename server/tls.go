@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"time"
+)
+
+// Certificate is a parsed kubernetes.io/tls secret.
+type Certificate struct {
+	Namespace string
+	Name      string
+	Cert      string
+	Key       string
+	Leaf      *x509.Certificate
+}
+
+// parseTLSSecret checks that the secret holds a matching certificate and key and parses the leaf certificate.
+func parseTLSSecret(sec *apiv1.Secret) (*Certificate, error) {
+	crt, key := sec.Data[apiv1.TLSCertKey], sec.Data[apiv1.TLSPrivateKeyKey]
+	if len(crt) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("secret '%v/%v' has no %v or %v", sec.Namespace, sec.Name, apiv1.TLSCertKey, apiv1.TLSPrivateKeyKey)
+	}
+	kp, e := tls.X509KeyPair(crt, key)
+	if e != nil {
+		return nil, fmt.Errorf("invalid certificate in secret '%v/%v', cause: %v", sec.Namespace, sec.Name, e)
+	}
+	leaf, e := x509.ParseCertificate(kp.Certificate[0])
+	if e != nil {
+		return nil, fmt.Errorf("invalid certificate in secret '%v/%v', cause: %v", sec.Namespace, sec.Name, e)
+	}
+	return &Certificate{
+		Namespace: sec.Namespace,
+		Name:      sec.Name,
+		Cert:      string(crt),
+		Key:       string(key),
+		Leaf:      leaf,
+	}, nil
+}
+
+// Covers is true if the certificate is valid now and names all hosts, wildcards included.
+func (c *Certificate) Covers(now time.Time, hosts ...string) bool {
+	if now.Before(c.Leaf.NotBefore) || now.After(c.Leaf.NotAfter) {
+		return false
+	}
+	for _, h := range hosts {
+		if c.Leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// indent writes a pem block as yaml literal with the given indentation.
+func indent(pem string, n int) string {
+	var b strings.Builder
+	pad := strings.Repeat(" ", n)
+	for _, l := range strings.Split(strings.TrimSpace(pem), "\n") {
+		b.WriteString("\n" + pad + l)
+	}
+	return b.String()
+}
+
+// ParseNamespacedName reads a namespace/name reference such as the default ssl certificate.
+func ParseNamespacedName(ref string) (string, string, error) {
+	ns, name, ok := strings.Cut(ref, "/")
+	if !ok || len(ns) == 0 || len(name) == 0 || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("invalid reference '%v', want namespace/name", ref)
+	}
+	return ns, name, nil
+}
+
+func (s *Server) fetchCertificate(ctx context.Context, ref string) (*Certificate, error) {
+	ns, name, e := ParseNamespacedName(ref)
+	if e != nil {
+		return nil, e
+	}
+	sec, e := s.getSecret(ctx, ns, name)
+	if e != nil {
+		return nil, fmt.Errorf("unable to fetch tls secret '%v', cause: %v", ref, e)
+	}
+	return parseTLSSecret(sec)
+}
+
+const certExpiryMetric = "ingress_j8a_certificate_expiry_days"
+
+// sniCertificates resolves the certificate for every tls host of the fleet and exports its days to expiry. Hosts
+// with a missing, invalid or expired secret, or one that does not name them, fall back to the default certificate.
+// These and certificates about to expire are reported on their ingress, reports only repeat when the cause changes.
+func (s *Server) sniCertificates(ctx context.Context, f *J8a, routes []Route, def *Certificate) map[string]*Certificate {
+	certs := make(map[string]*Certificate)
+	warnings := make(map[string]string)
+	warn := func(r Route, reason string, e error) {
+		key := r.Ingress + "/" + r.Host
+		warnings[key] = e.Error()
+		if f.tlsWarnings[key] != e.Error() {
+			s.Log.Errorf("%v for host '%v', cause: %v", reason, r.Host, e)
+			ns, name, _ := ParseNamespacedName(r.Ingress)
+			s.event(&netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, UID: r.IngressUID}},
+				apiv1.EventTypeWarning, reason, "host %v, cause: %v", r.Host, e)
+		}
+	}
+
+	s.Metrics.Reset(certExpiryMetric, "fleet", f.String())
+	now := time.Now()
+	for _, r := range routes {
+		if len(r.TLSSecret) == 0 || len(r.Host) == 0 {
+			continue
+		}
+		if _, ok := certs[r.Host]; ok {
+			continue
+		}
+		c, e := s.fetchCertificate(ctx, r.TLSSecret)
+		if e == nil {
+			s.Metrics.Set(certExpiryMetric, "days until the certificate served for a host expires",
+				map[string]string{"fleet": f.String(), "host": r.Host, "secret": r.TLSSecret},
+				c.Leaf.NotAfter.Sub(now).Hours()/24)
+			if !c.Covers(now, r.Host) {
+				e = fmt.Errorf("certificate in secret '%v' is not valid for host '%v' until %v", r.TLSSecret, r.Host, c.Leaf.NotAfter.Format(time.RFC3339))
+			} else if c.Leaf.NotAfter.Sub(now) < s.CertExpiryWarning {
+				warn(r, "CertificateExpiring", fmt.Errorf("certificate in secret '%v' expires %v", r.TLSSecret, c.Leaf.NotAfter.Format(time.RFC3339)))
+			}
+		}
+		if e != nil {
+			warn(r, "InvalidCertificate", fmt.Errorf("serving default certificate, %v", e))
+			c = def
+		}
+		if c != nil {
+			certs[r.Host] = c
+		}
+	}
+	f.tlsWarnings = warnings
+	return certs
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/record"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsSecret creates a kubernetes.io/tls secret with a self signed certificate for hosts.
+func tlsSecret(t *testing.T, namespace string, name string, notAfter time.Time, hosts ...string) *apiv1.Secret {
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if e != nil {
+		t.Fatalf("unable to create certificate, cause: %v", e)
+	}
+	kder, _ := x509.MarshalECPrivateKey(k)
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       apiv1.SecretTypeTLS,
+		Data: map[string][]byte{
+			apiv1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			apiv1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}),
+		},
+	}
+}
+
+func TestParseTLSSecret(t *testing.T) {
+	now := time.Now()
+	c, e := parseTLSSecret(tlsSecret(t, "default", "wild", now.Add(24*time.Hour), "*.example.com"))
+	if e != nil {
+		t.Fatalf("should parse tls secret, got %v", e)
+	}
+	if !c.Covers(now, "a.example.com") {
+		t.Errorf("wildcard certificate should cover subdomain")
+	}
+	if c.Covers(now, "example.com") || c.Covers(now, "a.b.example.com") {
+		t.Errorf("wildcard certificate should only cover one label")
+	}
+	if c.Covers(now.Add(48*time.Hour), "a.example.com") {
+		t.Errorf("expired certificate should not cover host")
+	}
+
+	broken := tlsSecret(t, "default", "broken", now.Add(24*time.Hour), "a.example.com")
+	broken.Data[apiv1.TLSPrivateKeyKey] = tlsSecret(t, "default", "other", now.Add(24*time.Hour), "a.example.com").Data[apiv1.TLSPrivateKeyKey]
+	if _, e := parseTLSSecret(broken); e == nil {
+		t.Errorf("should reject certificate with key of another certificate")
+	}
+}
+
+func TestParseNamespacedName(t *testing.T) {
+	if ns, n, e := ParseNamespacedName("j8a/default-cert"); e != nil || ns != "j8a" || n != "default-cert" {
+		t.Errorf("should parse namespace/name, got %v %v %v", ns, n, e)
+	}
+	for _, bad := range []string{"cert", "/cert", "j8a/", "a/b/c"} {
+		if _, _, e := ParseNamespacedName(bad); e == nil {
+			t.Errorf("should reject %v", bad)
+		}
+	}
+}
+
+func TestRenderSNI(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	fr := record.NewFakeRecorder(10)
+	s.Events.recorder = fr
+	f := s.Fleets[0]
+	s.DefaultCertificate = "j8a/default-cert"
+
+	soon := time.Now().Add(60 * 24 * time.Hour)
+	for _, sec := range []*apiv1.Secret{
+		tlsSecret(t, "j8a", "default-cert", soon, "default.example.com"),
+		tlsSecret(t, "default", "wild", soon, "*.example.com"),
+		tlsSecret(t, "default", "expired", time.Now().Add(-time.Hour), "old.example.org"),
+	} {
+		s.Kube.Client.CoreV1().Secrets(sec.Namespace).Create(context.TODO(), sec, metav1.CreateOptions{})
+	}
+
+	igrs := ingressFor("tls", f.IngressClass, netv1.ServiceBackendPort{Number: 80})
+	rule := igrs.Spec.Rules[0]
+	igrs.Spec.Rules = nil
+	for _, h := range []string{"a.example.com", "b.example.com", "old.example.org"} {
+		r := rule
+		r.Host = h
+		igrs.Spec.Rules = append(igrs.Spec.Rules, r)
+	}
+	igrs.Spec.TLS = []netv1.IngressTLS{
+		{Hosts: []string{"a.example.com", "b.example.com"}, SecretName: "wild"},
+		{Hosts: []string{"old.example.org"}, SecretName: "expired"},
+	}
+	s.updateCacheFromIngressList(context.TODO(), &netv1.IngressList{Items: []netv1.Ingress{*igrs}})
+
+	tls := s.renderTLS(context.TODO(), f, f.routes())
+	c, e := renderJ8aConfig(f, tls)
+	if e != nil {
+		t.Fatalf("should render config, got %v", e)
+	}
+	m := make(map[string]interface{})
+	if e := yaml.Unmarshal([]byte(c), &m); e != nil {
+		t.Fatalf("rendered config should be yaml, got %v\n%v", e, c)
+	}
+	sni := m["connection"].(map[string]interface{})["downstream"].(map[string]interface{})["tls"].(map[string]interface{})["sni"].([]interface{})
+	if len(sni) != 2 {
+		t.Errorf("want sni for 2 wildcard hosts, expired host falls back to default, got %v", sni)
+	}
+	if strings.Contains(tls, "old.example.org") {
+		t.Errorf("expired host should be served with default certificate, got\n%v", tls)
+	}
+
+	select {
+	case ev := <-fr.Events:
+		if !strings.HasPrefix(ev, "Warning InvalidCertificate") {
+			t.Errorf("want warning event for expired certificate, got %v", ev)
+		}
+	default:
+		t.Errorf("want event for expired certificate")
+	}
+	s.renderTLS(context.TODO(), f, f.routes())
+	if len(fr.Events) > 0 {
+		t.Errorf("should not repeat event for unchanged certificate")
+	}
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	fr := record.NewFakeRecorder(10)
+	s.Events.recorder = fr
+	f := s.Fleets[0]
+
+	s.Kube.Client.CoreV1().Secrets("default").Create(context.TODO(),
+		tlsSecret(t, "default", "www", time.Now().Add(10*24*time.Hour), "www.example.com"), metav1.CreateOptions{})
+	igrs := ingressFor("www", f.IngressClass, netv1.ServiceBackendPort{Number: 80})
+	igrs.Spec.Rules[0].Host = "www.example.com"
+	igrs.Spec.TLS = []netv1.IngressTLS{{Hosts: []string{"www.example.com"}, SecretName: "www"}}
+	s.updateCacheFromIngressList(context.TODO(), &netv1.IngressList{Items: []netv1.Ingress{*igrs}})
+
+	before := s.renderTLS(context.TODO(), f, f.routes())
+	days, ok := s.Metrics.Get(certExpiryMetric, map[string]string{"fleet": f.String(), "host": "www.example.com", "secret": "default/www"})
+	if !ok || days < 9 || days > 10 {
+		t.Errorf("want 10 days to expiry, got %v", days)
+	}
+	select {
+	case ev := <-fr.Events:
+		if !strings.HasPrefix(ev, "Warning CertificateExpiring") {
+			t.Errorf("want warning event for expiring certificate, got %v", ev)
+		}
+	default:
+		t.Errorf("want event for expiring certificate")
+	}
+
+	//a renewed secret changes the rendered config, so it rolls out.
+	s.Kube.Client.CoreV1().Secrets("default").Update(context.TODO(),
+		tlsSecret(t, "default", "www", time.Now().Add(90*24*time.Hour), "www.example.com"), metav1.UpdateOptions{})
+	if after := s.renderTLS(context.TODO(), f, f.routes()); after == before {
+		t.Errorf("renewed certificate should change tls config")
+	}
+	var b strings.Builder
+	s.Metrics.WriteTo(&b)
+	if !strings.Contains(b.String(), `ingress_j8a_certificate_expiry_days{fleet="default",host="www.example.com",secret="default/www"} 8`) {
+		t.Errorf("metrics should expose renewed expiry, got\n%v", b.String())
+	}
+}
+
+// objectRecorder keeps the objects events are recorded against.
+type objectRecorder struct {
+	objects []runtime.Object
+}
+
+func (r *objectRecorder) Event(o runtime.Object, eventType, reason, message string) {
+	r.objects = append(r.objects, o)
+}
+
+func (r *objectRecorder) Eventf(o runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	r.objects = append(r.objects, o)
+}
+
+func (r *objectRecorder) AnnotatedEventf(o runtime.Object, annotations map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	r.objects = append(r.objects, o)
+}
+
+func TestCertificateEventsNameIngress(t *testing.T) {
+	s := NewServer()
+	s.Kube.Client = newFakeClientset()
+	or := &objectRecorder{}
+	s.Events.recorder = or
+	f := s.Fleets[0]
+
+	igrs := ingressFor("tls", f.IngressClass, netv1.ServiceBackendPort{Number: 80})
+	igrs.UID = "4f1c"
+	igrs.Spec.Rules[0].Host = "a.example.com"
+	igrs.Spec.TLS = []netv1.IngressTLS{{Hosts: []string{"a.example.com"}, SecretName: "missing"}}
+	s.updateCacheFromIngressList(context.TODO(), &netv1.IngressList{Items: []netv1.Ingress{*igrs}})
+	s.renderTLS(context.TODO(), f, f.routes())
+
+	if len(or.objects) != 1 {
+		t.Fatalf("want one event for missing certificate, got %v", len(or.objects))
+	}
+	if m, _ := meta.Accessor(or.objects[0]); m.GetUID() != igrs.UID || m.GetName() != igrs.Name {
+		t.Errorf("event should reference the ingress by uid, got %v %v", m.GetName(), m.GetUID())
+	}
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"regexp"
+	"strings"
+)
+
+// Upgrade controls how a fleet moves to a new j8a image. With Canary one replica runs the new image before the
+// deployment is upgraded.
+type Upgrade struct {
+	Canary bool `json:"canary,omitempty"`
+}
+
+const (
+	canaryTrackLabel = "j8a.io/track"
+	// validateDeadlineSeconds bounds the validation job, including pulling the image.
+	validateDeadlineSeconds = 120
+	// validateTTLSeconds lets kube remove a finished validation job and its secret the controller did not collect.
+	validateTTLSeconds = 300
+)
+
+var (
+	versionPattern = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?$`)
+	digestPattern  = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+func (j *J8a) validateImage() error {
+	if !versionPattern.MatchString(j.Version) {
+		return fmt.Errorf("version must be semver, i.e. v1.1.0, got '%v'", j.Version)
+	}
+	if len(j.Digest) > 0 && !digestPattern.MatchString(j.Digest) {
+		return fmt.Errorf("digest must be sha256:<64 hex>, got '%v'", j.Digest)
+	}
+	if len(j.Image) == 0 || strings.ContainsAny(j.Image, "@ ") {
+		return fmt.Errorf("image must be a repository without tag or digest, got '%v'", j.Image)
+	}
+	return nil
+}
+
+// imageRef is the configured image, tagged with the version and pinned to the digest if there is one.
+func (j *J8a) imageRef() string {
+	ref := j.Image + ":" + strings.TrimPrefix(j.Version, "v")
+	if len(j.Digest) > 0 {
+		ref = ref + "@" + j.Digest
+	}
+	return ref
+}
+
+func (j *J8a) imagePullSecrets() []apiv1.LocalObjectReference {
+	var refs []apiv1.LocalObjectReference
+	for _, n := range j.ImagePullSecrets {
+		refs = append(refs, apiv1.LocalObjectReference{Name: n})
+	}
+	return refs
+}
+
+type upgradeState int
+
+const (
+	upgradePending upgradeState = iota
+	upgradeReady
+	upgradeFailed
+)
+
+// upgradeJ8a moves the deployment to the configured image once config is rolled out. The target image is validated
+// against config with its own j8a binary, then optionally runs as canary. A target that fails is not retried for this
+// config, the deployment keeps its image.
+func (s *Server) upgradeJ8a(ctx context.Context, f *J8a) error {
+	target := f.imageRef()
+	key := f.upgradeKey(target)
+	if target == f.image || f.rejectedImages[key] {
+		s.cleanupJ8aValidation(ctx, f, "")
+		return s.deleteJ8aCanary(ctx, f)
+	}
+
+	state, cause, e := upgradeReady, "", error(nil)
+	if s.Features.ValidateUpgrades && !f.validated[key] {
+		if state, cause, e = s.validateJ8aImage(ctx, f, target); e != nil {
+			return e
+		}
+		if state == upgradeReady {
+			f.validated[key] = true
+		}
+	}
+	if state == upgradeReady && f.Upgrade != nil && f.Upgrade.Canary {
+		if state, cause, e = s.runJ8aCanary(ctx, f, target); e != nil {
+			return e
+		}
+	}
+
+	switch state {
+	case upgradeFailed:
+		f.rejectedImages[key] = true
+		s.Log.Errorf("rejected upgrade of deployment '%v' to image '%v', cause: %v", f.Deployment.Name, target, cause)
+		if d, e := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.Deployment.Name, metav1.GetOptions{}); e == nil {
+			s.event(d, apiv1.EventTypeWarning, "UpgradeFailed", "image '%v' rejected, cause: %v", target, cause)
+		}
+		return s.deleteJ8aCanary(ctx, f)
+	case upgradeReady:
+		s.Log.Infof("upgrading deployment '%v' from image '%v' to '%v'", f.Deployment.Name, f.image, target)
+		f.rollout = s.startRollout(ctx, f, false, target)
+		f.rollout.previousImage = f.image
+		f.image = target
+		return s.deleteJ8aCanary(ctx, f)
+	}
+	return nil
+}
+
+// upgradeKey identifies an upgrade to target with the current config, a target is validated and rejected per config.
+func (j *J8a) upgradeKey(target string) string {
+	return target + " " + hashOf(j.config)
+}
+
+func (j *J8a) validateJobPrefix() string {
+	return j.Deployment.Name + "-validate-"
+}
+
+// validateJ8aImage runs 'j8a -o' of the target image against the config in a job. The config is passed from a
+// secret so private keys do not show in the job spec. Jobs of earlier configs or images are deleted.
+func (s *Server) validateJ8aImage(ctx context.Context, f *J8a, target string) (upgradeState, string, error) {
+	name := f.validateJobPrefix() + hashOf(target + f.config)[:10]
+	s.cleanupJ8aValidation(ctx, f, name)
+	jobsClient := s.Kube.Client.BatchV1().Jobs(f.Namespace)
+	job, e := jobsClient.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(e) {
+		return upgradePending, "", s.createJ8aValidateJob(ctx, f, name, target)
+	}
+	if e != nil {
+		return upgradePending, "", fmt.Errorf("unable to fetch job '%v', cause: %v", name, e)
+	}
+
+	state, cause := upgradePending, ""
+	for _, c := range job.Status.Conditions {
+		if c.Status != apiv1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			state = upgradeReady
+		case batchv1.JobFailed:
+			state, cause = upgradeFailed, fmt.Sprintf("config invalid for image, job '%v' failed, %v %v", name, c.Reason, c.Message)
+		}
+	}
+	if state != upgradePending {
+		s.deleteJ8aValidation(ctx, f, name)
+	}
+	return state, cause, nil
+}
+
+// cleanupJ8aValidation deletes the validation jobs of the fleet other than keep, i.e. those left behind when config
+// changed during validation. Without validation there are no jobs, and no permission to list them.
+func (s *Server) cleanupJ8aValidation(ctx context.Context, f *J8a, keep string) {
+	if !s.Features.ValidateUpgrades {
+		return
+	}
+	jl, e := s.Kube.Client.BatchV1().Jobs(f.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{ManagedByLabel: managedBy, InstanceLabel: f.String()}).String(),
+	})
+	if e != nil {
+		s.Log.Errorf("unable to list validation jobs of deployment '%v', cause: %v", f.Deployment.Name, e)
+		return
+	}
+	for _, j := range jl.Items {
+		if j.Name != keep && strings.HasPrefix(j.Name, f.validateJobPrefix()) {
+			s.deleteJ8aValidation(ctx, f, j.Name)
+		}
+	}
+}
+
+// deleteJ8aValidation deletes the job and its secret. The secret is owned by the job, it is deleted explicitly so
+// the private keys do not wait for garbage collection.
+func (s *Server) deleteJ8aValidation(ctx context.Context, f *J8a, name string) {
+	bg := metav1.DeletePropagationBackground
+	if e := s.Kube.Client.BatchV1().Jobs(f.Namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &bg}); e != nil && !errors.IsNotFound(e) {
+		s.Log.Errorf("unable to delete job '%v', cause: %v", name, e)
+	}
+	if e := s.Kube.Client.CoreV1().Secrets(f.Namespace).Delete(ctx, name, metav1.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
+		s.Log.Errorf("unable to delete secret '%v', cause: %v", name, e)
+	}
+}
+
+// createJ8aValidateJob creates the job before its secret, so the secret can be owned by the job and is collected
+// with it. The pod waits for the secret to show up.
+func (s *Server) createJ8aValidateJob(ctx context.Context, f *J8a, name string, target string) error {
+	c := apiv1.Container{
+		Name:  f.Pod.Name,
+		Image: target,
+		Args:  []string{"-o"},
+	}
+	if s.Features.ConfigFile {
+		c.Args = append(c.Args, "-c", configFileDir+"/"+configFileKey)
+		c.VolumeMounts = []apiv1.VolumeMount{{Name: configVolume, MountPath: configFileDir, ReadOnly: true}}
+	} else {
+		c.Env = []apiv1.EnvVar{{
+			Name: "J8ACFG_YML",
+			ValueFrom: &apiv1.EnvVarSource{SecretKeyRef: &apiv1.SecretKeySelector{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: name},
+				Key:                  configFileKey,
+			}},
+		}}
+	}
+	spec := f.Pod.podSpec(c)
+	if s.Features.ConfigFile {
+		spec.Volumes = append(spec.Volumes, apiv1.Volume{
+			Name:         configVolume,
+			VolumeSource: apiv1.VolumeSource{Secret: &apiv1.SecretVolumeSource{SecretName: name}},
+		})
+	}
+	spec.Containers[0].ReadinessProbe = nil
+	spec.Containers[0].LivenessProbe = nil
+	spec.RestartPolicy = apiv1.RestartPolicyNever
+	spec.ImagePullSecrets = f.imagePullSecrets()
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: f.Namespace},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            int32Ptr(0),
+			ActiveDeadlineSeconds:   int64Ptr(validateDeadlineSeconds),
+			TTLSecondsAfterFinished: int32Ptr(validateTTLSeconds),
+			Template:                apiv1.PodTemplateSpec{Spec: spec},
+		},
+	}
+	s.stamp(job, f, false)
+	jobsClient := s.Kube.Client.BatchV1().Jobs(f.Namespace)
+	created, e := jobsClient.Create(ctx, job, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(e) {
+		created, e = jobsClient.Get(ctx, name, metav1.GetOptions{})
+	}
+	if e != nil {
+		return fmt.Errorf("unable to create job '%v', cause: %v", name, e)
+	}
+
+	sec := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: f.Namespace, OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Name:       created.Name,
+			UID:        created.UID,
+		}}},
+		Data: map[string][]byte{configFileKey: []byte(f.config)},
+	}
+	s.stamp(sec, f, false)
+	if _, e := s.Kube.Client.CoreV1().Secrets(f.Namespace).Create(ctx, sec, metav1.CreateOptions{}); e != nil && !errors.IsAlreadyExists(e) {
+		return fmt.Errorf("unable to create secret '%v', cause: %v", name, e)
+	}
+	s.Log.Infof("validating config '%v' with image '%v' in job '%v'", hashOf(f.config), target, name)
+	return nil
+}
+
+func (j *J8a) canaryName() string {
+	return j.Deployment.Name + "-canary"
+}
+
+// runJ8aCanary applies a one replica deployment of the target image with the current config next to the fleet. Its
+// pods carry the fleet labels, so the service sends them a share of the traffic. Their track label keeps them out of
+// the disruption budget and of the pods judged by a rollout of the fleet deployment.
+func (s *Server) runJ8aCanary(ctx context.Context, f *J8a, target string) (upgradeState, string, error) {
+	want := f.desiredDeployment(f.config)
+	want.Name = f.canaryName()
+	want.Spec.Replicas = int32Ptr(1)
+	labels := map[string]string{canaryTrackLabel: "canary"}
+	for k, v := range f.Pod.Label {
+		labels[k] = v
+	}
+	want.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	want.Spec.Template.Labels = labels
+	for i := range want.Spec.Template.Spec.Containers {
+		want.Spec.Template.Spec.Containers[i].Image = target
+	}
+	if s.Features.ConfigFile {
+		f.withConfigFile(want, f.config)
+	}
+
+	deploymentsClient := s.Kube.Client.AppsV1().Deployments(f.Namespace)
+	e := s.reconcile(ctx, f, managed{
+		kind: "deployment",
+		name: want.Name,
+		want: want,
+		get: func(ctx context.Context) (runtime.Object, error) {
+			return deploymentsClient.Get(ctx, want.Name, metav1.GetOptions{})
+		},
+		apply: func(ctx context.Context, data []byte) error {
+			_, e := deploymentsClient.Patch(ctx, want.Name, types.ApplyPatchType, data, applyOptions())
+			return e
+		},
+	})
+	if e != nil {
+		return upgradePending, "", e
+	}
+	if f.canary == nil || f.canary.image != target {
+		f.canary = s.startRollout(ctx, f, true, target)
+		s.Log.Infof("running canary '%v' with image '%v'", want.Name, target)
+	}
+
+	d, e := deploymentsClient.Get(ctx, want.Name, metav1.GetOptions{})
+	if e != nil {
+		return upgradePending, "", fmt.Errorf("unable to fetch deployment '%v', cause: %v", want.Name, e)
+	}
+	switch state, cause := s.rolloutStatus(ctx, f, d, f.canary); state {
+	case rolloutComplete:
+		return upgradeReady, "", nil
+	case rolloutFailed:
+		return upgradeFailed, "canary " + cause, nil
+	}
+	return upgradePending, "", nil
+}
+
+func (s *Server) deleteJ8aCanary(ctx context.Context, f *J8a) error {
+	f.canary = nil
+	name := f.canaryName()
+	deploymentsClient := s.Kube.Client.AppsV1().Deployments(f.Namespace)
+	live, e := deploymentsClient.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(e) {
+		return nil
+	}
+	if e != nil {
+		return fmt.Errorf("unable to fetch deployment '%v', cause: %v", name, e)
+	}
+	if e := s.mayDelete("deployment", name, live, f); e != nil {
+		return e
+	}
+	if e := deploymentsClient.Delete(ctx, name, metav1.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
+		return fmt.Errorf("unable to delete deployment '%v', cause: %v", name, e)
+	}
+	delete(f.applied, "deployment/"+name)
+	s.Log.Infof("deleted canary '%v'", name)
+	return nil
+}
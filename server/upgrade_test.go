@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+)
+
+func TestValidateImage(t *testing.T) {
+	for _, j := range []*J8a{
+		{Version: "latest", Image: "simonmittag/j8a"},
+		{Version: "v1.2.0", Image: "simonmittag/j8a:v1.2.0@sha256:abc"},
+		{Version: "v1.2.0", Image: "simonmittag/j8a", Digest: "sha256:abc"},
+	} {
+		if j.validateImage() == nil {
+			t.Errorf("should reject %v %v %v", j.Image, j.Version, j.Digest)
+		}
+	}
+	j := &J8a{Version: "v1.2.0", Image: "registry.example.com:5000/j8a", Digest: "sha256:" + strings.Repeat("a", 64)}
+	if e := j.validateImage(); e != nil {
+		t.Errorf("should accept image, got %v", e)
+	}
+	if want := "registry.example.com:5000/j8a:1.2.0@sha256:" + strings.Repeat("a", 64); j.imageRef() != want {
+		t.Errorf("want image %v, got %v", want, j.imageRef())
+	}
+}
+
+func deployedImage(s *Server, f *J8a) string {
+	d, _ := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(context.TODO(), f.Deployment.Name, metav1.GetOptions{})
+	return d.Spec.Template.Spec.Containers[0].Image
+}
+
+// validateJob is the only validation job, with its status set to the condition.
+func validateJob(t *testing.T, s *Server, f *J8a, condition batchv1.JobConditionType) *batchv1.Job {
+	jl, _ := s.Kube.Client.BatchV1().Jobs(f.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if len(jl.Items) != 1 {
+		t.Fatalf("want one validation job, got %v", len(jl.Items))
+	}
+	job := &jl.Items[0]
+	job.Status.Conditions = []batchv1.JobCondition{{Type: condition, Status: apiv1.ConditionTrue}}
+	s.Kube.Client.BatchV1().Jobs(f.Namespace).UpdateStatus(context.TODO(), job, metav1.UpdateOptions{})
+	return job
+}
+
+func bootstrapUpgrade(t *testing.T) (*Server, *J8a) {
+	s := NewServer()
+	s.Features.ValidateUpgrades = true
+	s.Kube.Client = newFakeClientset()
+	s.Events.recorder = record.NewFakeRecorder(10)
+	f := s.Fleets[0]
+	if e := s.Bootstrap(context.TODO()); e != nil {
+		t.Fatalf("should bootstrap, got %v", e)
+	}
+	completeRollout(t, s, f)
+	if e := s.rolloutJ8aConfig(context.TODO(), f); e != nil {
+		t.Fatalf("should track rollout, got %v", e)
+	}
+	f.Version = "v1.2.0"
+	f.ImagePullSecrets = []string{"registry"}
+	return s, f
+}
+
+func TestUpgradeValidatesThenCanaries(t *testing.T) {
+	s, f := bootstrapUpgrade(t)
+	f.Upgrade = &Upgrade{Canary: true}
+	ctx := context.TODO()
+
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should start upgrade, got %v", e)
+	}
+	job := validateJob(t, s, f, batchv1.JobComplete)
+	c := job.Spec.Template.Spec.Containers[0]
+	if c.Image != "simonmittag/j8a:1.2.0" || c.Env[0].ValueFrom.SecretKeyRef == nil || job.Spec.Template.Spec.ImagePullSecrets[0].Name != "registry" {
+		t.Errorf("should validate config from secret with new image, got %+v", c)
+	}
+	sec, e := s.Kube.Client.CoreV1().Secrets(f.Namespace).Get(ctx, job.Name, metav1.GetOptions{})
+	if e != nil || len(sec.OwnerReferences) != 1 || sec.OwnerReferences[0].Name != job.Name || job.Spec.TTLSecondsAfterFinished == nil {
+		t.Errorf("validation secret should be owned by its job which expires, got %v", e)
+	}
+	if deployedImage(s, f) != "simonmittag/j8a:1.1.0" {
+		t.Errorf("should not upgrade before validation")
+	}
+
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should run canary, got %v", e)
+	}
+	if _, e := s.Kube.Client.BatchV1().Jobs(f.Namespace).Get(ctx, job.Name, metav1.GetOptions{}); e == nil {
+		t.Errorf("should delete validation job")
+	}
+	canary, e := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.canaryName(), metav1.GetOptions{})
+	if e != nil || *canary.Spec.Replicas != 1 || canary.Spec.Template.Spec.Containers[0].Image != "simonmittag/j8a:1.2.0" {
+		t.Fatalf("should run one canary replica with new image, got %v", e)
+	}
+	if deployedImage(s, f) != "simonmittag/j8a:1.1.0" {
+		t.Errorf("should not upgrade before canary is available")
+	}
+
+	completeDeployment(t, s, f.Namespace, f.canaryName())
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should upgrade, got %v", e)
+	}
+	if deployedImage(s, f) != "simonmittag/j8a:1.2.0" {
+		t.Errorf("should upgrade after canary, got %v", deployedImage(s, f))
+	}
+	if _, e := s.Kube.Client.AppsV1().Deployments(f.Namespace).Get(ctx, f.canaryName(), metav1.GetOptions{}); e == nil {
+		t.Errorf("should delete canary after upgrade")
+	}
+}
+
+func TestUpgradeRejectedByValidator(t *testing.T) {
+	s, f := bootstrapUpgrade(t)
+	ctx := context.TODO()
+
+	s.rolloutJ8aConfig(ctx, f)
+	validateJob(t, s, f, batchv1.JobFailed)
+	if e := s.rolloutJ8aConfig(ctx, f); e != nil {
+		t.Fatalf("should reject upgrade, got %v", e)
+	}
+	if deployedImage(s, f) != "simonmittag/j8a:1.1.0" {
+		t.Errorf("should keep image when validation fails")
+	}
+
+	s.rolloutJ8aConfig(ctx, f)
+	if jl, _ := s.Kube.Client.BatchV1().Jobs(f.Namespace).List(ctx, metav1.ListOptions{}); len(jl.Items) != 0 {
+		t.Errorf("should not validate rejected image again, got %v jobs", len(jl.Items))
+	}
+}
+
+func TestValidationJobCleanup(t *testing.T) {
+	s, f := bootstrapUpgrade(t)
+	s.Features.ConfigFile = true
+	ctx := context.TODO()
+
+	s.rolloutJ8aConfig(ctx, f)
+	stale := validateJob(t, s, f, batchv1.JobComplete)
+	c := stale.Spec.Template.Spec.Containers[0]
+	if len(c.Env) != 0 || len(c.Args) != 3 || c.Args[2] != configFileDir+"/"+configFileKey {
+		t.Errorf("should validate config from file in config file mode, got %v %v", c.Args, c.Env)
+	}
+
+	//config changes while validating, the job is stale
+	s.Kube.Client.BatchV1().Jobs(f.Namespace).UpdateStatus(ctx, &batchv1.Job{ObjectMeta: stale.ObjectMeta}, metav1.UpdateOptions{})
+	f.Version = "v1.3.0"
+	s.rolloutJ8aConfig(ctx, f)
+	jl, _ := s.Kube.Client.BatchV1().Jobs(f.Namespace).List(ctx, metav1.ListOptions{})
+	if len(jl.Items) != 1 || jl.Items[0].Name == stale.Name {
+		t.Errorf("should replace stale validation job, got %v", jl.Items)
+	}
+	if _, e := s.Kube.Client.CoreV1().Secrets(f.Namespace).Get(ctx, stale.Name, metav1.GetOptions{}); e == nil {
+		t.Errorf("should delete secret of stale validation job")
+	}
+
+	f.Version = "v1.1.0"
+	s.rolloutJ8aConfig(ctx, f)
+	if jl, _ := s.Kube.Client.BatchV1().Jobs(f.Namespace).List(ctx, metav1.ListOptions{}); len(jl.Items) != 0 {
+		t.Errorf("should delete validation jobs without pending upgrade, got %v", len(jl.Items))
+	}
+}